@@ -0,0 +1,355 @@
+// Lute DOCX - 一款将 Markdown 文本转换为 Word 文档 (.docx) 的小工具
+// Copyright (c) 2020-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/unidoc/unioffice/document"
+	"github.com/unidoc/unioffice/measurement"
+	"github.com/unidoc/unioffice/schema/soo/wml"
+	"gopkg.in/yaml.v3"
+)
+
+// DocxCover 描述了 DOCX 封面。
+type DocxCover struct {
+	Title             string           // 标题
+	AuthorLabel       string           // 作者标签，为空时使用当前语言环境的文案
+	Author            string           // 作者
+	AuthorLink        string           // 作者链接
+	LinkLabel         string           // 原文链接标签，为空时使用当前语言环境的文案
+	Link              string           // 原文链接
+	SourceLabel       string           // 来源网站标签，为空时使用当前语言环境的文案
+	Source            string           // 来源网站
+	SourceLink        string           // 来源网站链接
+	LicenseLabel      string           // 许可协议标签，为空时使用当前语言环境的文案
+	License           string           // 许可协议
+	LicenseLink       string           // 许可协议链接
+	LogoLink          string           // 图标链接
+	LogoTitle         string           // 图片标题
+	LogoTitleLink     string           // 图标标题链接
+	DateLabel         string           // 日期标签，为空时使用当前语言环境的文案
+	Date              string           // 日期
+	VersionLabel      string           // 版本标签，为空时使用当前语言环境的文案
+	Version           string           // 版本
+	AbstractLabel     string           // 摘要标签，为空时使用当前语言环境的文案
+	Abstract          string           // 摘要
+	OrganizationLabel string           // 组织标签，为空时使用当前语言环境的文案
+	Organization      string           // 组织
+	Layout            *DocxCoverLayout // 布局，为空时使用 classic 布局
+	Template          string           // 封面模板 DOCX 文件路径，设置后使用模板生成封面而不使用布局
+	QRCode            string           // 原文链接二维码位置，cover 封面、footer 页脚或者 both 两者，为空时不生成
+	QRCodeSize        float64          // 二维码边长（毫米），为 0 时使用默认值
+	QRCodeAlign       string           // 二维码对齐方式，left、center 或者 right，为空时封面居中、页脚居右
+}
+
+// DocxCoverLayout 描述了封面布局，封面元素按顺序自上而下排列。
+type DocxCoverLayout struct {
+	Name     string              `yaml:"name"`     // 布局名称
+	Elements []*DocxCoverElement `yaml:"elements"` // 封面元素
+}
+
+// DocxCoverElement 描述了封面布局中的一个元素，字段值为空时不渲染该元素。
+type DocxCoverElement struct {
+	Field       string  `yaml:"field"`       // 字段，logo、logoTitle、title、author、link、source、license、date、version、abstract、organization 或者 qrcode
+	Size        float64 `yaml:"size"`        // 字号（磅），logo 为图标宽度（毫米），qrcode 为二维码边长（毫米），为 0 时使用默认值
+	Bold        bool    `yaml:"bold"`        // 是否加粗
+	Align       string  `yaml:"align"`       // 对齐方式，left、center 或者 right
+	SpaceBefore float64 `yaml:"spaceBefore"` // 段前间距（磅）
+	SpaceAfter  float64 `yaml:"spaceAfter"`  // 段后间距（磅）
+	Label       bool    `yaml:"label"`       // 是否在字段值前显示标签
+}
+
+// coverLayouts 定义了内置的封面布局。
+var coverLayouts = map[string]*DocxCoverLayout{
+	"classic": {
+		Name: "classic",
+		Elements: []*DocxCoverElement{
+			{Field: "logo", Align: "center", SpaceBefore: 140, SpaceAfter: 24},
+			{Field: "logoTitle", Align: "center", SpaceAfter: 24},
+			{Field: "title", Size: 28, Align: "center", SpaceAfter: 72},
+			{Field: "organization", Size: 12, Label: true},
+			{Field: "author", Size: 12, Label: true},
+			{Field: "link", Size: 12, Label: true},
+			{Field: "source", Size: 12, Label: true},
+			{Field: "license", Size: 12, Label: true},
+			{Field: "version", Size: 12, Label: true},
+			{Field: "date", Size: 12, Label: true},
+			{Field: "abstract", Size: 12, SpaceBefore: 24},
+			{Field: "qrcode", SpaceBefore: 24},
+		},
+	},
+	"corporate": {
+		Name: "corporate",
+		Elements: []*DocxCoverElement{
+			{Field: "logo", Size: 30, Align: "left", SpaceAfter: 12},
+			{Field: "organization", Size: 14, Bold: true, Align: "left", SpaceAfter: 160},
+			{Field: "title", Size: 32, Bold: true, Align: "left", SpaceAfter: 12},
+			{Field: "abstract", Size: 12, Align: "left", SpaceAfter: 120},
+			{Field: "author", Size: 12, Align: "left", Label: true},
+			{Field: "version", Size: 12, Align: "left", Label: true},
+			{Field: "date", Size: 12, Align: "left", Label: true},
+			{Field: "link", Size: 10, Align: "left", Label: true},
+			{Field: "source", Size: 10, Align: "left", Label: true},
+			{Field: "license", Size: 10, Align: "left", Label: true},
+			{Field: "qrcode", Align: "left", SpaceBefore: 12},
+		},
+	},
+	"minimal": {
+		Name: "minimal",
+		Elements: []*DocxCoverElement{
+			{Field: "title", Size: 28, Align: "center", SpaceBefore: 260},
+			{Field: "qrcode", SpaceBefore: 120},
+		},
+	},
+}
+
+// CoverLayout 返回名称为 name 的内置封面布局。
+func CoverLayout(name string) (*DocxCoverLayout, bool) {
+	layout, ok := coverLayouts[strings.ToLower(name)]
+	return layout, ok
+}
+
+// LoadCoverLayout 从 YAML（或者 JSON）文件 path 中加载自定义封面布局，比如：
+//
+//	name: custom
+//	elements:
+//	  - field: title
+//	    size: 30
+//	    bold: true
+//	    align: center
+//	    spaceBefore: 200
+//	  - field: author
+//	    size: 12
+//	    align: center
+//	    label: true
+func LoadCoverLayout(path string) (*DocxCoverLayout, error) {
+	data, err := ioutil.ReadFile(path)
+	if nil != err {
+		return nil, err
+	}
+
+	ret := &DocxCoverLayout{}
+	if err = yaml.Unmarshal(data, ret); nil != err {
+		return nil, err
+	}
+	if 1 > len(ret.Elements) {
+		return nil, fmt.Errorf("cover layout [%s] has no elements", path)
+	}
+	return ret, nil
+}
+
+// RenderCover 渲染封面，设置了封面模板时复制模板内容，否则按照封面布局渲染。
+func (r *DocxRenderer) RenderCover() {
+	r.applyTheme()
+	r.prefetchImages()
+	r.sectionCover = true
+	r.frontMatter = true
+
+	rendered := false
+	if "" != r.Cover.Template {
+		if err := r.renderCoverTemplate(); nil != err {
+			logger.Warnf("render cover template [%s] failed: %s, use cover layout instead", r.Cover.Template, err)
+		} else {
+			rendered = true
+		}
+	}
+	if !rendered {
+		layout := r.Cover.Layout
+		if nil == layout {
+			layout = coverLayouts["classic"]
+		}
+		for _, element := range layout.Elements {
+			r.renderCoverElement(element)
+		}
+	}
+
+	if "" != r.Cover.Link {
+		footer := r.doc.AddFooter()
+		para := footer.AddParagraph()
+		para.Properties().SetAlignment(wml.ST_JcRight)
+		if r.Cover.qrCodeOn("footer") {
+			r.renderFooterQRCode(footer, para)
+		}
+		run := para.AddRun()
+		run.Properties().SetSize(8)
+		run.AddText(r.coverLabel(r.Cover.LinkLabel, "coverLink"))
+		link := para.AddHyperLink()
+		link.SetTarget(r.Cover.Link)
+		run = link.AddRun()
+		run.Properties().SetStyle(r.styleID("Hyperlink"))
+		run.AddText(r.Cover.Link)
+
+		r.linkFooter = &footer
+	}
+
+	r.columns = 1
+	r.closeSection(wml.ST_SectionMarkNextPage, 1)
+}
+
+// renderCoverElement 渲染封面元素 element。
+func (r *DocxRenderer) renderCoverElement(element *DocxCoverElement) {
+	cover := r.Cover
+	var label, value, link string
+	switch element.Field {
+	case "logo":
+		if "" == cover.LogoLink {
+			return
+		}
+		r.renderCoverLogo(element)
+		return
+	case "qrcode":
+		if "" == cover.Link || !cover.qrCodeOn("cover") {
+			return
+		}
+		r.renderCoverQRCode(element)
+		return
+	case "logoTitle":
+		value, link = cover.LogoTitle, cover.LogoTitleLink
+	case "title":
+		value = cover.Title
+	case "author":
+		label, value, link = r.coverLabel(cover.AuthorLabel, "coverAuthor"), cover.Author, cover.AuthorLink
+	case "link":
+		label, value, link = r.coverLabel(cover.LinkLabel, "coverLink"), cover.Link, cover.Link
+	case "source":
+		label, value, link = r.coverLabel(cover.SourceLabel, "coverSource"), cover.Source, cover.SourceLink
+	case "license":
+		label, value, link = r.coverLabel(cover.LicenseLabel, "coverLicense"), cover.License, cover.LicenseLink
+	case "date":
+		label, value = r.coverLabel(cover.DateLabel, "coverDate"), cover.Date
+	case "version":
+		label, value = r.coverLabel(cover.VersionLabel, "coverVersion"), cover.Version
+	case "abstract":
+		label, value = r.coverLabel(cover.AbstractLabel, "coverAbstract"), cover.Abstract
+	case "organization":
+		label, value = r.coverLabel(cover.OrganizationLabel, "coverOrganization"), cover.Organization
+	default:
+		logger.Warnf("unsupported cover field [%s]", element.Field)
+		return
+	}
+	if "" == value {
+		return
+	}
+	if !element.Label {
+		label = ""
+	}
+
+	para := r.addCoverParagraph(element)
+	size := measurement.Distance(element.Size)
+	if 0 >= size {
+		size = 12
+	}
+	if "" != label {
+		run := para.AddRun()
+		run.Properties().SetSize(size)
+		run.Properties().SetBold(element.Bold)
+		run.AddText(label)
+	}
+	var run document.Run
+	if "" == link {
+		run = para.AddRun()
+	} else {
+		hyperlink := para.AddHyperLink()
+		hyperlink.SetTarget(link)
+		run = hyperlink.AddRun()
+		run.Properties().SetStyle(r.styleID("Hyperlink"))
+	}
+	run.Properties().SetSize(size)
+	run.Properties().SetBold(element.Bold)
+	run.AddText(value)
+}
+
+// renderCoverLogo 渲染封面图标。
+func (r *DocxRenderer) renderCoverLogo(element *DocxCoverElement) {
+	data, ok := r.loadImage(r.Cover.LogoLink)
+	if !ok {
+		return
+	}
+
+	imgRef, img, err := r.addImage(data)
+	if nil != err {
+		logger.Warnf("add cover logo [%s] failed: %s", r.Cover.LogoLink, err)
+		return
+	}
+	width, height := r.imageSize(data, img.Size.X, img.Size.Y, nil)
+	para := r.addCoverParagraph(element)
+	inline, _ := para.AddRun().AddDrawingInline(imgRef)
+	if 0 < element.Size {
+		height = height * mm(element.Size) / width
+		width = mm(element.Size)
+	}
+	inline.SetSize(width, height)
+	setImageDescription(inline, r.Cover.LogoTitle, "")
+}
+
+// addCoverParagraph 添加一个封面段落，并按照封面元素 element 设置对齐方式和段落间距。
+func (r *DocxRenderer) addCoverParagraph(element *DocxCoverElement) document.Paragraph {
+	para := r.doc.AddParagraph()
+	props := para.Properties()
+	switch strings.ToLower(element.Align) {
+	case "center":
+		props.SetAlignment(wml.ST_JcCenter)
+	case "right":
+		props.SetAlignment(wml.ST_JcRight)
+	default:
+		props.SetAlignment(wml.ST_JcLeft)
+	}
+	props.SetSpacing(measurement.Distance(element.SpaceBefore), measurement.Distance(element.SpaceAfter))
+	return para
+}
+
+// coverLabel 返回封面标签，label 为空时使用当前语言环境中 key 对应的文案。
+func (r *DocxRenderer) coverLabel(label, key string) string {
+	if "" != label {
+		return label
+	}
+	return r.localize(key)
+}
+
+// SetFrontMatter 使用 YAML Front Matter 中的字段填充封面，支持的字段有 title、author、authorLink、link、
+// source、sourceLink、license、licenseLink、logo、logoTitle、logoTitleLink、date、version、abstract 和 organization。
+func (cover *DocxCover) SetFrontMatter(frontMatter map[string]string) {
+	for key, field := range cover.fields() {
+		if value := frontMatter[key]; "" != value {
+			*field = value
+		}
+	}
+}
+
+// fields 返回 YAML Front Matter 字段名到封面字段的映射。
+func (cover *DocxCover) fields() map[string]*string {
+	return map[string]*string{
+		"title":         &cover.Title,
+		"author":        &cover.Author,
+		"authorLink":    &cover.AuthorLink,
+		"link":          &cover.Link,
+		"source":        &cover.Source,
+		"sourceLink":    &cover.SourceLink,
+		"license":       &cover.License,
+		"licenseLink":   &cover.LicenseLink,
+		"logo":          &cover.LogoLink,
+		"logoTitle":     &cover.LogoTitle,
+		"logoTitleLink": &cover.LogoTitleLink,
+		"date":          &cover.Date,
+		"version":       &cover.Version,
+		"abstract":      &cover.Abstract,
+		"organization":  &cover.Organization,
+	}
+}
@@ -0,0 +1,480 @@
+// Lute DOCX - 一款将 Markdown 文本转换为 Word 文档 (.docx) 的小工具
+// Copyright (c) 2020-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/unidoc/unioffice"
+	"github.com/unidoc/unioffice/common"
+	"github.com/unidoc/unioffice/document"
+	"github.com/unidoc/unioffice/schema/soo/wml"
+)
+
+// coverPlaceholderRegexp 用于匹配封面模板中的占位符，比如 {{title}}。
+var coverPlaceholderRegexp = regexp.MustCompile(`\{\{\s*([^{}\s]+)\s*\}\}`)
+
+// renderCoverTemplate 将封面模板 DOCX 的正文内容（包括图片、样式和超链接）复制到文档中，并替换其中的占位符。
+//
+// 占位符 {{key}} 的取值依次取自封面字段和 YAML Front Matter，key 和 YAML Front Matter 中的字段名一致，
+// 比如 {{title}}、{{author}}、{{date}}。模板中的页眉页脚和分节设置不会被复制。
+//
+// Word 内置的封面将内容放在内容控件（w:sdt）和文本框（w:txbxContent）中，所以这里直接处理正文的 XML，
+// 替换所有段落中的占位符并重新映射所有关系 ID，包含不支持的关系（比如嵌入对象、图表）的模板会返回错误。
+func (r *DocxRenderer) renderCoverTemplate() error {
+	tpl, err := document.Open(r.Cover.Template)
+	if nil != err {
+		return err
+	}
+	defer os.RemoveAll(tpl.TmpPath)
+
+	// unioffice 打开文档时不会记录图片的关系 ID，所以需要直接从压缩包中读取正文、关系和图片
+	zr, err := zip.OpenReader(r.Cover.Template)
+	if nil != err {
+		return err
+	}
+	defer zr.Close()
+	rels, err := templateRelationships(&zr.Reader)
+	if nil != err {
+		return err
+	}
+	data, err := readZipFile(&zr.Reader, "word/document.xml")
+	if nil != err {
+		return err
+	}
+	root, err := parseXMLNode(data)
+	if nil != err {
+		return err
+	}
+
+	values := r.FrontMatter()
+	for key, field := range r.Cover.fields() {
+		if "" != *field {
+			values[key] = *field
+		}
+	}
+
+	namespaces := root.namespaces()
+	var relNodes []*xmlNode
+	var relAttrs []*xml.Attr
+	root.walk(func(node *xmlNode) {
+		// 模板中的分节设置引用了模板的页眉页脚，不复制
+		node.children = node.filter(func(child *xmlNode) bool {
+			return !child.is(namespaces, wmlNamespace, "sectPr")
+		})
+		var runs []*xmlNode
+		for _, child := range node.children {
+			if child.is(namespaces, wmlNamespace, "r") {
+				runs = append(runs, child)
+			}
+		}
+		replaceCoverPlaceholders(runs, namespaces, values)
+		for i := range node.attrs {
+			if relNamespace == namespaces[node.attrs[i].Name.Space] {
+				relAttrs = append(relAttrs, &node.attrs[i])
+				relNodes = append(relNodes, node)
+			}
+		}
+	})
+
+	// 先检查所有关系，避免复制了部分图片后才发现不支持的关系
+	for _, attr := range relAttrs {
+		if rel, ok := rels[attr.Value]; ok && !isSupportedTemplateRelationship(rel) {
+			return fmt.Errorf("unsupported relationship [%s] of type [%s]", rel.ID, rel.Type)
+		}
+	}
+	remapped := map[string]string{}
+	for _, attr := range relAttrs {
+		if attr.Value, err = r.copyTemplateRelationship(&zr.Reader, rels, attr.Value, remapped); nil != err {
+			return err
+		}
+	}
+	for _, node := range relNodes {
+		// 去掉模板中不存在的关系的引用
+		var attrs []xml.Attr
+		for _, attr := range node.attrs {
+			if "" != attr.Value || relNamespace != namespaces[attr.Name.Space] {
+				attrs = append(attrs, attr)
+			}
+		}
+		node.attrs = attrs
+	}
+
+	buf := &bytes.Buffer{}
+	root.write(buf)
+	cover := wml.NewDocument()
+	if err = xml.Unmarshal(buf.Bytes(), cover); nil != err {
+		return err
+	}
+	if nil == cover.Body {
+		return nil
+	}
+
+	r.copyTemplateStyles(tpl)
+	body := r.doc.X().Body
+	body.EG_BlockLevelElts = append(body.EG_BlockLevelElts, cover.Body.EG_BlockLevelElts...)
+	return nil
+}
+
+// isSupportedTemplateRelationship 判断是否支持复制封面模板中的关系 rel，目前支持内嵌图片和超链接。
+func isSupportedTemplateRelationship(rel templateRelationship) bool {
+	switch rel.Type {
+	case unioffice.ImageType:
+		return "External" != rel.TargetMode
+	case unioffice.HyperLinkType:
+		return true
+	}
+	return false
+}
+
+// copyTemplateRelationship 将封面模板压缩包 zr 中 ID 为 relID 的关系复制到文档中，返回文档中的关系 ID，
+// remapped 用于记录已经复制过的关系。模板中不存在的关系会被忽略并返回空字符串。
+func (r *DocxRenderer) copyTemplateRelationship(zr *zip.Reader, rels map[string]templateRelationship, relID string, remapped map[string]string) (string, error) {
+	if newRelID, ok := remapped[relID]; ok {
+		return newRelID, nil
+	}
+
+	rel, ok := rels[relID]
+	if !ok {
+		logger.Warnf("relationship [%s] not found in cover template [%s]", relID, r.Cover.Template)
+		return "", nil
+	}
+	switch rel.Type {
+	case unioffice.ImageType:
+		target := rel.Target
+		if strings.HasPrefix(target, "/") {
+			target = target[1:]
+		} else {
+			target = path.Join("word", target)
+		}
+		data, err := readZipFile(zr, target)
+		if nil != err {
+			return "", err
+		}
+		imgRef, _, err := r.addImage(data)
+		if nil != err {
+			return "", err
+		}
+		remapped[relID] = imgRef.RelID()
+	case unioffice.HyperLinkType:
+		remapped[relID] = common.Relationship(r.doc.AddHyperlink(rel.Target)).ID()
+	default:
+		return "", fmt.Errorf("unsupported relationship [%s] of type [%s]", rel.ID, rel.Type)
+	}
+	return remapped[relID], nil
+}
+
+// copyTemplateStyles 将封面模板 tpl 中文档里没有的样式复制到文档中，同名样式以文档为准。
+func (r *DocxRenderer) copyTemplateStyles(tpl *document.Document) {
+	styles := r.doc.Styles.X()
+	existing := map[string]bool{}
+	for _, style := range styles.Style {
+		if nil != style.StyleIdAttr {
+			existing[*style.StyleIdAttr] = true
+		}
+	}
+	for _, style := range tpl.Styles.X().Style {
+		if nil == style.StyleIdAttr || existing[*style.StyleIdAttr] {
+			continue
+		}
+		styles.Style = append(styles.Style, style)
+	}
+}
+
+// templateRelationship 描述了 DOCX 文件中正文的一个关系。
+type templateRelationship struct {
+	ID         string `xml:"Id,attr"`
+	Type       string `xml:"Type,attr"`
+	Target     string `xml:"Target,attr"`
+	TargetMode string `xml:"TargetMode,attr"`
+}
+
+// templateRelationships 读取 DOCX 压缩包 zr 中正文的关系，返回关系 ID 到关系的映射。
+func templateRelationships(zr *zip.Reader) (map[string]templateRelationship, error) {
+	data, err := readZipFile(zr, "word/_rels/document.xml.rels")
+	if nil != err {
+		return nil, err
+	}
+
+	rels := struct {
+		Relationships []templateRelationship `xml:"Relationship"`
+	}{}
+	if err = xml.Unmarshal(data, &rels); nil != err {
+		return nil, err
+	}
+	ret := map[string]templateRelationship{}
+	for _, rel := range rels.Relationships {
+		ret[rel.ID] = rel
+	}
+	return ret, nil
+}
+
+// readZipFile 读取压缩包 zr 中名称为 name 的文件。
+func readZipFile(zr *zip.Reader, name string) ([]byte, error) {
+	for _, f := range zr.File {
+		if name != f.Name {
+			continue
+		}
+		rc, err := f.Open()
+		if nil != err {
+			return nil, err
+		}
+		defer rc.Close()
+		return ioutil.ReadAll(rc)
+	}
+	return nil, fmt.Errorf("file [%s] not found", name)
+}
+
+// replaceCoverPlaceholders 替换相邻文本块 runs 中的占位符。Word 经常将一个占位符拆分到多个文本块中，
+// 这时占位符的值会写入占位符开始的文本块，占位符在其他文本块中的部分会被删除，不包含占位符的文本保持不变。
+func replaceCoverPlaceholders(runs []*xmlNode, namespaces map[string]string, values map[string]string) {
+	texts := make([]string, len(runs))
+	for i, run := range runs {
+		texts[i] = runText(run, namespaces)
+	}
+	for i, changed := range replacePlaceholders(texts, values) {
+		if changed {
+			setRunText(runs[i], namespaces, texts[i])
+		}
+	}
+}
+
+// replacePlaceholders 替换相邻文本 texts 中的占位符，占位符可以跨越多段文本，返回每段文本是否被修改。
+func replacePlaceholders(texts []string, values map[string]string) (changed []bool) {
+	changed = make([]bool, len(texts))
+	starts := make([]int, len(texts))
+	buf := strings.Builder{}
+	for i, text := range texts {
+		starts[i] = buf.Len()
+		buf.WriteString(text)
+	}
+	full := buf.String()
+	// textAt 返回包含偏移 offset 处字符的文本下标
+	textAt := func(offset int) int {
+		return sort.Search(len(starts), func(i int) bool { return starts[i] > offset }) - 1
+	}
+
+	// 从后向前替换，这样替换后面的占位符不会影响前面占位符的偏移
+	matches := coverPlaceholderRegexp.FindAllStringSubmatchIndex(full, -1)
+	for i := len(matches) - 1; 0 <= i; i-- {
+		match := matches[i]
+		key := full[match[2]:match[3]]
+		value, ok := values[key]
+		if !ok {
+			logger.Warnf("cover template placeholder [%s] has no value", key)
+		}
+
+		first, last := textAt(match[0]), textAt(match[1]-1)
+		if first == last {
+			texts[first] = texts[first][:match[0]-starts[first]] + value + texts[first][match[1]-starts[first]:]
+		} else {
+			texts[last] = texts[last][match[1]-starts[last]:]
+			for j := first + 1; j < last; j++ {
+				texts[j] = ""
+			}
+			texts[first] = texts[first][:match[0]-starts[first]] + value
+		}
+		for j := first; j <= last; j++ {
+			changed[j] = true
+		}
+	}
+	return
+}
+
+// runText 返回文本块 run 中的文本。
+func runText(run *xmlNode, namespaces map[string]string) string {
+	buf := strings.Builder{}
+	for _, child := range run.children {
+		if child.is(namespaces, wmlNamespace, "t") {
+			buf.WriteString(child.text())
+		}
+	}
+	return buf.String()
+}
+
+// setRunText 将文本块 run 中的文本设置为 text，保留其他内容。
+func setRunText(run *xmlNode, namespaces map[string]string, text string) {
+	run.children = run.filter(func(child *xmlNode) bool {
+		if !child.is(namespaces, wmlNamespace, "t") {
+			return true
+		}
+		if "" == text {
+			return false
+		}
+		child.children = []*xmlNode{{chars: text}}
+		child.setAttr(xml.Name{Space: "xml", Local: "space"}, "preserve")
+		text = ""
+		return true
+	})
+}
+
+const (
+	wmlNamespace = "http://schemas.openxmlformats.org/wordprocessingml/2006/main"
+	relNamespace = "http://schemas.openxmlformats.org/officeDocument/2006/relationships"
+)
+
+// xmlNode 描述了保留原始命名空间前缀的 XML 节点，用于直接处理 DOCX 中的 XML。
+type xmlNode struct {
+	name     xml.Name   // 元素名，Space 为命名空间前缀
+	attrs    []xml.Attr // 属性，Name.Space 为命名空间前缀
+	children []*xmlNode // 子节点
+	chars    string     // 文本节点的内容
+}
+
+// parseXMLNode 解析 XML 数据 data，返回根元素。
+func parseXMLNode(data []byte) (*xmlNode, error) {
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	var root *xmlNode
+	var stack []*xmlNode
+	for {
+		token, err := decoder.RawToken()
+		if io.EOF == err {
+			break
+		}
+		if nil != err {
+			return nil, err
+		}
+
+		switch t := token.(type) {
+		case xml.StartElement:
+			node := &xmlNode{name: t.Name, attrs: append([]xml.Attr{}, t.Attr...)}
+			if 0 < len(stack) {
+				parent := stack[len(stack)-1]
+				parent.children = append(parent.children, node)
+			} else if nil == root {
+				root = node
+			}
+			stack = append(stack, node)
+		case xml.EndElement:
+			if 1 > len(stack) {
+				return nil, fmt.Errorf("unexpected end element [%s]", t.Name.Local)
+			}
+			stack = stack[:len(stack)-1]
+		case xml.CharData:
+			if 0 < len(stack) {
+				parent := stack[len(stack)-1]
+				parent.children = append(parent.children, &xmlNode{chars: string(t)})
+			}
+		}
+	}
+	if nil == root {
+		return nil, errors.New("no root element")
+	}
+	return root, nil
+}
+
+// namespaces 返回 node 及其子孙元素中声明的命名空间前缀到命名空间的映射。
+func (node *xmlNode) namespaces() map[string]string {
+	ret := map[string]string{}
+	node.walk(func(n *xmlNode) {
+		for _, attr := range n.attrs {
+			if "xmlns" == attr.Name.Space {
+				ret[attr.Name.Local] = attr.Value
+			} else if "" == attr.Name.Space && "xmlns" == attr.Name.Local {
+				ret[""] = attr.Value
+			}
+		}
+	})
+	return ret
+}
+
+// is 判断 node 是否是命名空间 namespace 中名称为 local 的元素。
+func (node *xmlNode) is(namespaces map[string]string, namespace, local string) bool {
+	return local == node.name.Local && namespace == namespaces[node.name.Space]
+}
+
+// walk 先序遍历 node 及其子孙元素。
+func (node *xmlNode) walk(visit func(n *xmlNode)) {
+	if "" == node.name.Local {
+		return
+	}
+	visit(node)
+	for _, child := range node.children {
+		child.walk(visit)
+	}
+}
+
+// filter 返回 node 的子节点中 keep 返回 true 的节点。
+func (node *xmlNode) filter(keep func(child *xmlNode) bool) (ret []*xmlNode) {
+	for _, child := range node.children {
+		if keep(child) {
+			ret = append(ret, child)
+		}
+	}
+	return
+}
+
+// text 返回 node 中的文本。
+func (node *xmlNode) text() string {
+	buf := strings.Builder{}
+	for _, child := range node.children {
+		if "" == child.name.Local {
+			buf.WriteString(child.chars)
+		}
+	}
+	return buf.String()
+}
+
+// setAttr 设置 node 的属性 name 为 value。
+func (node *xmlNode) setAttr(name xml.Name, value string) {
+	for i := range node.attrs {
+		if name == node.attrs[i].Name {
+			node.attrs[i].Value = value
+			return
+		}
+	}
+	node.attrs = append(node.attrs, xml.Attr{Name: name, Value: value})
+}
+
+// write 将 node 序列化到 buf 中，元素和属性使用原始的命名空间前缀。
+func (node *xmlNode) write(buf *bytes.Buffer) {
+	if "" == node.name.Local {
+		xml.EscapeText(buf, []byte(node.chars))
+		return
+	}
+
+	buf.WriteString("<" + qualifiedName(node.name))
+	for _, attr := range node.attrs {
+		buf.WriteString(" " + qualifiedName(attr.Name) + `="`)
+		xml.EscapeText(buf, []byte(attr.Value))
+		buf.WriteString(`"`)
+	}
+	buf.WriteString(">")
+	for _, child := range node.children {
+		child.write(buf)
+	}
+	buf.WriteString("</" + qualifiedName(node.name) + ">")
+}
+
+// qualifiedName 返回带命名空间前缀的名称。
+func qualifiedName(name xml.Name) string {
+	if "" == name.Space {
+		return name.Local
+	}
+	return name.Space + ":" + name.Local
+}
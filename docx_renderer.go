@@ -17,15 +17,13 @@
 package main
 
 import (
+	"bytes"
+	"encoding/xml"
 	"fmt"
-	"image"
-	"io/ioutil"
-	"math"
-	"net/http"
-	"net/url"
 	"os"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/88250/lute/ast"
@@ -33,11 +31,10 @@ import (
 	"github.com/88250/lute/parse"
 	"github.com/88250/lute/render"
 	"github.com/88250/lute/util"
-	"github.com/unidoc/unioffice/color"
-	"github.com/unidoc/unioffice/common"
 	"github.com/unidoc/unioffice/document"
 	"github.com/unidoc/unioffice/measurement"
 	"github.com/unidoc/unioffice/schema/soo/wml"
+	"gopkg.in/yaml.v3"
 )
 
 // DocxRenderer 描述了 DOCX 渲染器。
@@ -45,11 +42,27 @@ type DocxRenderer struct {
 	*render.BaseRenderer
 	needRenderFootnotesDef bool
 
-	Cover *DocxCover // 封面
+	Cover           *DocxCover        // 封面
+	PageSetup       *DocxPageSetup    // 页面设置
+	HeaderFooter    *DocxHeaderFooter // 页眉页脚
+	Locale          string            // 语言环境，支持 zh_CN、zh_TW、en_US 和 ja_JP
+	LocaleOverrides map[string]string // 覆盖内置文案
+	Theme           *DocxTheme        // 主题，为空时使用 light 主题
+	BaseDir         string            // 解析图片和链接相对路径的基础目录，为空时使用当前工作目录
+	SearchPaths     []string          // 图片搜索路径，在 BaseDir 中找不到图片时依次查找
+	RestrictLocal   bool              // 是否只允许引用 BaseDir 和 SearchPaths 中的本地文件，用于转换不受信任的 Markdown
+	ImageDPI        float64           // 图片中没有记录 DPI 时使用的 DPI，为 0 时使用 96
+	ImageMaxHeight  float64           // 图片最大高度（毫米），为 0 时使用版心高度，图片宽度不超过栏宽
+	WarnMissingAlt  bool              // 图片没有替代文本时是否输出警告
+	ImageCacheDir   string            // 图片缓存目录，按照内容寻址保存下载的图片，为空时不缓存
+	ImageCacheTTL   time.Duration     // 图片缓存有效期，过期的图片会重新下载，为 0 时永不过期
+	ImageWorkers    int               // 并发下载图片数，为 0 时使用 8
+	Offline         bool              // 离线模式，只使用图片缓存和本地图片
+	ImageResolver   ImageResolver     // 图片解析器，为空时依次使用本地文件和 HTTP 图片解析器
 
 	doc          *document.Document    // DOCX 生成器句柄
 	zoom         float64               // 字体、行高大小倍数
-	fontSize     int                   // 字体大小
+	fontSize     float64               // 字体大小
 	lineHeight   float64               // 行高
 	heading1Size float64               // 一级标题大小
 	heading2Size float64               // 二级标题大小
@@ -57,164 +70,74 @@ type DocxRenderer struct {
 	heading4Size float64               // 四级标题大小
 	heading5Size float64               // 五级标题大小
 	heading6Size float64               // 六级标题大小
-	margin       float64               // 页边距
+	emojiFont    string                // Emoji 字体
+	emojis       map[rune][]string     // Emoji 首字符到以该字符开头的 Emoji 的映射，按照长度降序排列
+	figures      int                   // 已经渲染的图片题注数
+	figureIDs    map[string]int        // 图片标识到图片编号的映射
+	bookmarkID   int64                 // 最近一个书签的 ID
 	paragraphs   []*document.Paragraph // 当前段落栈
 	runs         []*document.Run       // 当前排版栈
-	images       []string              // 生成图片后待清理的临时文件路径
-}
-
-// DocxCover 描述了 DOCX 封面。
-type DocxCover struct {
-	Title         string // 标题
-	AuthorLabel   string // 作者：
-	Author        string // 作者
-	AuthorLink    string // 作者链接
-	LinkLabel     string // 原文链接：
-	Link          string // 原文链接
-	SourceLabel   string // 来源网站：
-	Source        string // 来源网站
-	SourceLink    string // 来源网站链接
-	LicenseLabel  string // 许可协议：
-	License       string // 许可协议
-	LicenseLink   string // 许可协议链接
-	LogoLink      string // 图标链接
-	LogoTitle     string // 图片标题
-	LogoTitleLink string // 图标标题链接
-}
-
-func (r *DocxRenderer) RenderCover() {
-	para := r.doc.AddParagraph()
-	run := para.AddRun()
-	run.AddBreak()
-	run.AddBreak()
-	run.AddBreak()
-	run.AddBreak()
-	run.AddBreak()
-	run.AddBreak()
-	run.AddBreak()
-	run.AddBreak()
-	run.AddBreak()
-	run.AddBreak()
-	logoImgPath, ok, isTemp := r.downloadImg(r.Cover.LogoLink)
-	if ok {
-		img, _ := common.ImageFromFile(logoImgPath)
-		imgRef, _ := r.doc.AddImage(img)
-		para.Properties().SetAlignment(wml.ST_JcCenter)
-		inline, _ := run.AddDrawingInline(imgRef)
-		width, height := r.getImgSize(logoImgPath)
-		inline.SetSize(measurement.Distance(width), measurement.Distance(height))
-
-		if isTemp {
-			r.images = append(r.images, logoImgPath)
-		}
+	links        []document.HyperLink  // 当前超链接栈
+	fetched      map[string][]byte     // 预下载的图片地址到图片内容的映射，下载失败时内容为空
+	media        map[string]mediaImage // 图片内容哈希到已经添加到文档中的图片的映射
+	resolverOnce sync.Once             // 用于创建默认图片解析器
+	resolver     ImageResolver         // 没有设置 ImageResolver 时使用的默认图片解析器
+	columns      int                   // 当前分节的分栏数
+	sectionType  wml.ST_SectionMark    // 当前分节的开始方式
+	sectionCover bool                  // 当前分节是否是封面
+
+	frontMatter       bool // 当前分节是否是前置部分（封面、目录）
+	hasFrontMatter    bool // 是否存在前置部分
+	restartPageNumber bool // 下一个正文分节是否需要从 1 开始重新编页码
+
+	headers    map[wml.ST_HdrFtr]document.Header // 页眉
+	footers    map[wml.ST_HdrFtr]document.Footer // 页脚
+	linkFooter *document.Footer                  // 封面生成的原文链接页脚
+
+	referenceDoc        bool                       // 是否基于参考文档生成
+	referenceHdrFtrRefs []*wml.EG_HdrFtrReferences // 参考文档中的页眉页脚引用
+	styleIDs            map[string]string          // 渲染使用的样式 ID 到文档中实际样式 ID 的映射
+}
+
+// FrontMatter 返回 Markdown 中 YAML Front Matter 的字段，非字符串的值会被格式化为字符串。
+func (r *DocxRenderer) FrontMatter() (ret map[string]string) {
+	ret = map[string]string{}
+	yamlFrontMatter := r.Tree.Root.ChildByType(ast.NodeYamlFrontMatter)
+	if nil == yamlFrontMatter {
+		return
+	}
+	content := yamlFrontMatter.ChildByType(ast.NodeYamlFrontMatterContent)
+	if nil == content {
+		return
 	}
 
-	run.AddBreak()
-	run.AddBreak()
-	run.AddText(r.Cover.LogoTitle)
-	run.AddBreak()
-	run.AddBreak()
-
-	run = para.AddRun()
-	run.Properties().SetSize(28)
-	run.AddText(r.Cover.Title)
-	run.AddBreak()
-	run.AddBreak()
-	run.AddBreak()
-
-	para = r.doc.AddParagraph()
-	run = para.AddRun()
-	run.Properties().SetSize(12)
-	run.AddText(r.Cover.AuthorLabel)
-	link := para.AddHyperLink()
-	link.SetTarget(r.Cover.AuthorLink)
-	run = link.AddRun()
-	run.Properties().SetStyle("Hyperlink")
-	run.AddText(r.Cover.Author)
-	run.AddBreak()
-
-	run = para.AddRun()
-	run.Properties().SetSize(12)
-	run.AddText(r.Cover.LinkLabel)
-	link = para.AddHyperLink()
-	link.SetTarget(r.Cover.Link)
-	run = link.AddRun()
-	run.Properties().SetStyle("Hyperlink")
-	run.AddText(r.Cover.Link)
-	run.AddBreak()
-
-	run = para.AddRun()
-	run.Properties().SetSize(12)
-	run.AddText(r.Cover.SourceLabel)
-	link = para.AddHyperLink()
-	link.SetTarget(r.Cover.Source)
-	run = link.AddRun()
-	run.Properties().SetStyle("Hyperlink")
-	run.AddText(r.Cover.Source)
-	run.AddBreak()
-
-	run = para.AddRun()
-	run.Properties().SetSize(12)
-	run.AddText(r.Cover.LicenseLabel)
-	link = para.AddHyperLink()
-	link.SetTarget(r.Cover.LicenseLink)
-	run = link.AddRun()
-	run.Properties().SetStyle("Hyperlink")
-	run.AddText(r.Cover.License)
-	run.AddBreak()
-
-	footer := r.doc.AddFooter()
-	para = footer.AddParagraph()
-	para.Properties().SetAlignment(wml.ST_JcRight)
-	run = para.AddRun()
-	run.Properties().SetSize(8)
-	run.AddText(r.Cover.LinkLabel)
-	link = para.AddHyperLink()
-	link.SetTarget(r.Cover.Link)
-	run = link.AddRun()
-	run.Properties().SetStyle("Hyperlink")
-	run.AddText(r.Cover.Link)
-
-	para = r.doc.AddParagraph()
-	section := para.Properties().AddSection(wml.ST_SectionMarkContinuous)
-	section.SetFooter(footer, wml.ST_HdrFtrDefault)
+	values := map[string]interface{}{}
+	if err := yaml.Unmarshal(content.Tokens, &values); nil != err {
+		logger.Warnf("parse YAML front matter failed: %s", err)
+		return
+	}
+	for key, value := range values {
+		switch v := value.(type) {
+		case nil:
+		case time.Time:
+			ret[key] = v.Format("2006-01-02")
+		default:
+			ret[key] = fmt.Sprint(v)
+		}
+	}
+	return
 }
 
 // NewDocxRenderer 创建一个 HTML 渲染器。
 func NewDocxRenderer(tree *parse.Tree, options *render.Options) *DocxRenderer {
-	doc := document.New()
-	linkStyle := doc.Styles.AddStyle("Hyperlink", wml.ST_StyleTypeCharacter, false)
-	linkStyle.SetName("Hyperlink")
-	linkStyle.SetBasedOn("DefaultParagraphFont")
-	linkColor := color.FromHex("#4285F4")
-	linkStyle.RunProperties().Color().SetColor(linkColor)
-	linkStyle.RunProperties().SetUnderline(wml.ST_UnderlineSingle, linkColor)
-
-	codeStyle := doc.Styles.AddStyle("Code", wml.ST_StyleTypeCharacter, false)
-	codeStyle.SetName("Code")
-	codeStyle.SetBasedOn("DefaultParagraphFont")
-	codeColor := color.FromHex("#FF9933")
-	codeStyle.RunProperties().Color().SetColor(codeColor)
-	codeStyle.RunProperties().SetUnderline(wml.ST_UnderlineSingle, codeColor)
-
-	codeBlockStyle := doc.Styles.AddStyle("CodeBlock", wml.ST_StyleTypeCharacter, false)
-	codeBlockStyle.SetName("Code")
-	codeBlockStyle.SetBasedOn("DefaultParagraphFont")
-	codeBlockColor := color.FromHex("#569E3D")
-	codeBlockStyle.RunProperties().Color().SetColor(codeBlockColor)
-	codeBlockStyle.RunProperties().SetUnderline(wml.ST_UnderlineSingle, codeBlockColor)
+	return newDocxRenderer(tree, options, document.New(), false)
+}
 
+func newDocxRenderer(tree *parse.Tree, options *render.Options, doc *document.Document, referenceDoc bool) *DocxRenderer {
 	ret := &DocxRenderer{BaseRenderer: render.NewBaseRenderer(tree, options), needRenderFootnotesDef: false, doc: doc}
-	ret.zoom = 0.8
-	ret.fontSize = int(math.Floor(14 * ret.zoom))
-	ret.lineHeight = 24.0 * ret.zoom
-	ret.heading1Size = 24 * ret.zoom
-	ret.heading2Size = 22 * ret.zoom
-	ret.heading3Size = 20 * ret.zoom
-	ret.heading4Size = 18 * ret.zoom
-	ret.heading5Size = 16 * ret.zoom
-	ret.heading6Size = 14 * ret.zoom
-	ret.margin = 60 * ret.zoom
+	ret.referenceDoc = referenceDoc
+	ret.PageSetup = NewDocxPageSetup()
+	ret.Locale = defaultLocale
 
 	ret.RendererFuncs[ast.NodeDocument] = ret.renderDocument
 	ret.RendererFuncs[ast.NodeParagraph] = ret.renderParagraph
@@ -287,11 +210,19 @@ func NewDocxRenderer(tree *parse.Tree, options *render.Options) *DocxRenderer {
 	ret.RendererFuncs[ast.NodeToC] = ret.renderToC
 	ret.RendererFuncs[ast.NodeBackslash] = ret.renderBackslash
 	ret.RendererFuncs[ast.NodeBackslashContent] = ret.renderBackslashContent
+	ret.RendererFuncs[ast.NodeYamlFrontMatter] = ret.renderYamlFrontMatter
 	return ret
 }
 
 func (r *DocxRenderer) Render() (output []byte) {
+	r.applyTheme()
+	r.prefetchImages()
 	r.LastOut = lex.ItemNewline
+	r.columns = r.PageSetup.Columns
+	if r.hasColumnsDirective() {
+		// 使用分栏指令时，指令以外的内容保持通栏
+		r.columns = 1
+	}
 
 	ast.Walk(r.Tree.Root, func(n *ast.Node, entering bool) ast.WalkStatus {
 		extRender := r.ExtRendererFuncs[n.Type]
@@ -311,6 +242,7 @@ func (r *DocxRenderer) Render() (output []byte) {
 		}
 		return render(n, entering)
 	})
+	r.renderBodySection()
 
 	if 0 < len(r.FootnotesDefs) {
 		output = r.RenderFootnotesDefs(r.Tree.Context)
@@ -332,6 +264,11 @@ func (r *DocxRenderer) renderBackslashContent(node *ast.Node, entering bool) ast
 	return ast.WalkContinue
 }
 
+func (r *DocxRenderer) renderYamlFrontMatter(node *ast.Node, entering bool) ast.WalkStatus {
+	// YAML Front Matter 仅用于填充封面等元数据，不渲染到正文中
+	return ast.WalkSkipChildren
+}
+
 func (r *DocxRenderer) renderBackslash(node *ast.Node, entering bool) ast.WalkStatus {
 	return ast.WalkContinue
 }
@@ -343,19 +280,41 @@ func (r *DocxRenderer) renderToC(node *ast.Node, entering bool) ast.WalkStatus {
 		if 1 > length {
 			return ast.WalkContinue
 		}
-		r.WriteString("<div class=\"toc-div\">")
-		for i, heading := range headings {
-			level := strconv.Itoa(heading.HeadingLevel)
-			spaces := (heading.HeadingLevel - 1) * 2
-			r.WriteString(strings.Repeat("&emsp;", spaces))
-			r.WriteString("<span class=\"toc-h" + level + "\">")
-			r.WriteString("<a class=\"toc-a\" href=\"#toc_h" + level + "_" + strconv.Itoa(i) + "\">" + heading.Text() + "</a></span><br>")
+
+		isFrontMatter := r.isFrontMatterToC(node)
+		if isFrontMatter {
+			r.frontMatter = true
+		}
+
+		para := r.doc.AddParagraph()
+		para.SetStyle(r.styleID("TOCHeading"))
+		para.AddRun().AddText(r.localize("toc"))
+		para = r.doc.AddParagraph()
+		run := para.AddRun()
+		run.AddFieldWithFormatting(`TOC \o "1-6" \h \z \u`, "", true)
+		r.doc.Settings.SetUpdateFieldsOnOpen(true)
+
+		if isFrontMatter {
+			// 目录属于前置部分，单独分节，正文从新页开始
+			r.closeSection(wml.ST_SectionMarkNextPage, r.columns)
 		}
-		r.WriteString("</div>\n\n")
 	}
 	return ast.WalkContinue
 }
 
+// isFrontMatterToC 判断目录节点 toc 是否位于文档开头，即属于前置部分。
+func (r *DocxRenderer) isFrontMatterToC(toc *ast.Node) bool {
+	if ast.NodeDocument != toc.Parent.Type {
+		return false
+	}
+	for prev := toc.Previous; nil != prev; prev = prev.Previous {
+		if ast.NodeYamlFrontMatter != prev.Type {
+			return false
+		}
+	}
+	return true
+}
+
 func (r *DocxRenderer) headings() (ret []*ast.Node) {
 	for n := r.Tree.Root.FirstChild; nil != n; n = n.Next {
 		r.headings0(n, &ret)
@@ -452,7 +411,7 @@ func (r *DocxRenderer) renderCodeBlockLike(content []byte) {
 	para := r.doc.AddParagraph()
 	r.pushPara(&para)
 	run := para.AddRun()
-	run.Properties().SetStyle("CodeBlock")
+	run.Properties().SetStyle(r.styleID("CodeBlock"))
 	r.pushRun(&run)
 	r.WriteString(util.BytesToStr(content))
 	run.AddBreak()
@@ -464,7 +423,7 @@ func (r *DocxRenderer) renderCodeBlockLike(content []byte) {
 func (r *DocxRenderer) renderCodeSpanLike(content []byte) {
 	para := r.peekPara()
 	run := para.AddRun()
-	run.Properties().SetStyle("Code")
+	run.Properties().SetStyle(r.styleID("Code"))
 	r.pushRun(&run)
 	r.WriteString(util.BytesToStr(content))
 	r.popRun()
@@ -481,32 +440,82 @@ func (r *DocxRenderer) reRun() {
 	}
 }
 
-func (r *DocxRenderer) renderCodeBlockCloseMarker(node *ast.Node, entering bool) ast.WalkStatus {
-	return ast.WalkContinue
+// addRunLike 在文本块 run 所在的超链接或者段落中添加一个文本块，新文本块沿用 run 的格式（粗体、斜体、删除线、链接样式等）。
+func (r *DocxRenderer) addRunLike(run *document.Run) document.Run {
+	var ret document.Run
+	if link := r.runLink(run); nil != link {
+		ret = link.AddRun()
+	} else {
+		ret = r.peekPara().AddRun()
+	}
+	if nil != run && nil != run.X().RPr {
+		if err := copyRunProperties(ret.X(), run.X()); nil != err {
+			logger.Warnf("copy run properties failed: %s", err)
+		}
+	}
+	return ret
 }
 
-func (r *DocxRenderer) renderCodeBlockInfoMarker(node *ast.Node, entering bool) ast.WalkStatus {
-	return ast.WalkContinue
+// insertRun 在当前文本块之后插入一个沿用当前格式的文本块并返回，之后的文本输出到一个同样沿用当前格式的新文本块中。
+//
+// 用于在文本中间插入 Emoji、域等需要单独文本块的内容，不会丢失粗体、斜体、超链接等格式。
+func (r *DocxRenderer) insertRun() document.Run {
+	current := r.peekRun()
+	if nil == current {
+		return r.peekPara().AddRun()
+	}
+	r.popRun()
+	ret := r.addRunLike(current)
+	next := r.addRunLike(current)
+	r.pushRun(&next)
+	return ret
 }
 
-func (r *DocxRenderer) renderCodeBlockOpenMarker(node *ast.Node, entering bool) ast.WalkStatus {
-	return ast.WalkContinue
+// runLink 返回包含文本块 run 的当前超链接，run 不在当前超链接中时返回 nil。
+func (r *DocxRenderer) runLink(run *document.Run) *document.HyperLink {
+	if nil == run || 1 > len(r.links) {
+		return nil
+	}
+	link := &r.links[len(r.links)-1]
+	for _, content := range link.X().EG_ContentRunContent {
+		if content.R == run.X() {
+			return link
+		}
+	}
+	return nil
 }
 
-func (r *DocxRenderer) renderEmojiAlias(node *ast.Node, entering bool) ast.WalkStatus {
-	return ast.WalkContinue
+// copyRunProperties 将文本块 src 的属性深拷贝到文本块 dst，拷贝后修改 dst 的属性不会影响 src。
+func copyRunProperties(dst, src *wml.CT_R) error {
+	buf := &bytes.Buffer{}
+	encoder := xml.NewEncoder(buf)
+	start := xml.StartElement{
+		Name: xml.Name{Local: "w:rPr"},
+		Attr: []xml.Attr{{Name: xml.Name{Local: "xmlns:w"}, Value: "http://schemas.openxmlformats.org/wordprocessingml/2006/main"}},
+	}
+	if err := src.RPr.MarshalXML(encoder, start); nil != err {
+		return err
+	}
+	if err := encoder.Flush(); nil != err {
+		return err
+	}
+	rPr := wml.NewCT_RPr()
+	if err := xml.Unmarshal(buf.Bytes(), rPr); nil != err {
+		return err
+	}
+	dst.RPr = rPr
+	return nil
 }
 
-func (r *DocxRenderer) renderEmojiImg(node *ast.Node, entering bool) ast.WalkStatus {
+func (r *DocxRenderer) renderCodeBlockCloseMarker(node *ast.Node, entering bool) ast.WalkStatus {
 	return ast.WalkContinue
 }
 
-func (r *DocxRenderer) renderEmojiUnicode(node *ast.Node, entering bool) ast.WalkStatus {
+func (r *DocxRenderer) renderCodeBlockInfoMarker(node *ast.Node, entering bool) ast.WalkStatus {
 	return ast.WalkContinue
 }
 
-func (r *DocxRenderer) renderEmoji(node *ast.Node, entering bool) ast.WalkStatus {
-	// 暂不渲染 Emoji，字体似乎有问题
+func (r *DocxRenderer) renderCodeBlockOpenMarker(node *ast.Node, entering bool) ast.WalkStatus {
 	return ast.WalkContinue
 }
 
@@ -655,7 +664,7 @@ func (r *DocxRenderer) renderLinkSpace(node *ast.Node, entering bool) ast.WalkSt
 func (r *DocxRenderer) renderLinkText(node *ast.Node, entering bool) ast.WalkStatus {
 	if entering {
 		if ast.NodeImage != node.Parent.Type {
-			r.Write(node.Tokens)
+			r.renderFigureRefs(util.BytesToStr(node.Tokens))
 		}
 	}
 	return ast.WalkContinue
@@ -686,16 +695,10 @@ func (r *DocxRenderer) renderImage(node *ast.Node, entering bool) ast.WalkStatus
 		if 0 == r.DisableTags {
 			destTokens := node.ChildByType(ast.NodeLinkDest).Tokens
 			src := util.BytesToStr(destTokens)
-			src, ok, isTemp := r.downloadImg(src)
-			if ok {
-				img, _ := common.ImageFromFile(src)
-				imgRef, _ := r.doc.AddImage(img)
-				inline, _ := r.peekRun().AddDrawingInline(imgRef)
-				width, height := r.getImgSize(src)
-				inline.SetSize(measurement.Distance(width), measurement.Distance(height))
-				if isTemp {
-					r.images = append(r.images, src)
-				}
+			attrs := markdownImageAttrs(node)
+			r.checkImageAlt(src, attrs)
+			if data, ok := r.loadImage(src); ok {
+				r.renderImageInline(data, src, attrs)
 			}
 		}
 		r.DisableTags++
@@ -715,18 +718,50 @@ func (r *DocxRenderer) renderImage(node *ast.Node, entering bool) ast.WalkStatus
 	return ast.WalkContinue
 }
 
+// renderImageInline 将地址为 src 的图片 data 作为行内图片渲染到当前文本块中，并按照图片属性 attrs 设置尺寸和所在段落的对齐方式。
+func (r *DocxRenderer) renderImageInline(data []byte, src string, attrs *imageAttrs) {
+	imgRef, img, err := r.addImage(data)
+	if nil != err {
+		logger.Warnf("add image [%s] failed: %s", shortImageSrc(src), err)
+		return
+	}
+	width, height := r.imageSize(data, img.Size.X, img.Size.Y, attrs)
+	inline, err := r.peekRun().AddDrawingInline(imgRef)
+	if nil != err {
+		logger.Warnf("add image [%s] failed: %s", shortImageSrc(src), err)
+		return
+	}
+	inline.SetSize(width, height)
+	if nil != attrs {
+		setImageDescription(inline, attrs.Alt, attrs.Title)
+	}
+	alignImageParagraph(r.peekPara(), attrs)
+}
+
 func (r *DocxRenderer) renderLink(node *ast.Node, entering bool) ast.WalkStatus {
 	if entering {
 		dest := node.ChildByType(ast.NodeLinkDest)
 		destTokens := dest.Tokens
-		destTokens = r.RelativePath(destTokens)
+		target, allowed := util.BytesToStr(destTokens), true
+		if "" == r.Options.LinkBase {
+			target, allowed = r.localLinkTarget(target)
+		} else {
+			target = util.BytesToStr(r.RelativePath(destTokens))
+		}
 		para := r.peekPara()
 		link := para.AddHyperLink()
-		link.SetTarget(util.BytesToStr(destTokens))
+		if allowed {
+			link.SetTarget(target)
+		} else {
+			// 不允许的本地链接只保留链接文本
+			logger.Warnf("link [%s] is not allowed", target)
+		}
+		r.links = append(r.links, link)
 		run := link.AddRun()
-		run.Properties().SetStyle("Hyperlink")
+		run.Properties().SetStyle(r.styleID("Hyperlink"))
 		r.pushRun(&run)
 	} else {
+		r.links = r.links[:len(r.links)-1]
 		r.popRun()
 		r.reRun()
 	}
@@ -735,6 +770,12 @@ func (r *DocxRenderer) renderLink(node *ast.Node, entering bool) ast.WalkStatus
 
 func (r *DocxRenderer) renderHTML(node *ast.Node, entering bool) ast.WalkStatus {
 	if entering {
+		if r.renderDirective(node.Tokens) {
+			return ast.WalkContinue
+		}
+		if r.renderHTMLImageBlock(node.Tokens) {
+			return ast.WalkContinue
+		}
 		r.renderCodeBlockLike(node.Tokens)
 	}
 	return ast.WalkContinue
@@ -742,6 +783,10 @@ func (r *DocxRenderer) renderHTML(node *ast.Node, entering bool) ast.WalkStatus
 
 func (r *DocxRenderer) renderInlineHTML(node *ast.Node, entering bool) ast.WalkStatus {
 	if entering {
+		if imgTagRegexp.Match(node.Tokens) {
+			r.renderHTMLImage(util.BytesToStr(node.Tokens))
+			return ast.WalkContinue
+		}
 		r.renderCodeSpanLike(node.Tokens)
 	}
 	return ast.WalkContinue
@@ -753,8 +798,8 @@ func (r *DocxRenderer) renderDocument(node *ast.Node, entering bool) ast.WalkSta
 
 func (r *DocxRenderer) Save(docxPath string) {
 	err := r.doc.SaveToFile(docxPath)
-	for _, img := range r.images {
-		os.Remove(img)
+	if "" != r.doc.TmpPath {
+		os.RemoveAll(r.doc.TmpPath)
 	}
 	if nil != err {
 		logger.Fatal(err)
@@ -781,6 +826,17 @@ func (r *DocxRenderer) renderParagraph(node *ast.Node, entering bool) ast.WalkSt
 		return ast.WalkContinue
 	}
 
+	if nil != figureImage(node) || isLoFParagraph(node) {
+		if entering {
+			if img := figureImage(node); nil != img {
+				r.renderFigure(img)
+			} else {
+				r.renderLoF()
+			}
+		}
+		return ast.WalkSkipChildren
+	}
+
 	isFirstParaInList := false
 	if inList {
 		isFirstParaInList = node.Parent.FirstChild == node
@@ -789,6 +845,9 @@ func (r *DocxRenderer) renderParagraph(node *ast.Node, entering bool) ast.WalkSt
 	if entering {
 		if !inList {
 			para := r.doc.AddParagraph()
+			if ast.NodeBlockquote == node.Parent.Type {
+				para.SetStyle(r.styleID("Quote"))
+			}
 			r.pushPara(&para)
 			run := para.AddRun()
 			r.pushRun(&run)
@@ -833,8 +892,7 @@ func (r *DocxRenderer) renderParagraph(node *ast.Node, entering bool) ast.WalkSt
 
 func (r *DocxRenderer) renderText(node *ast.Node, entering bool) ast.WalkStatus {
 	if entering {
-		text := util.BytesToStr(node.Tokens)
-		r.WriteString(text)
+		r.renderFigureRefs(util.BytesToStr(node.Tokens))
 	}
 	return ast.WalkContinue
 }
@@ -926,34 +984,14 @@ func (r *DocxRenderer) renderHeading(node *ast.Node, entering bool) ast.WalkStat
 	if entering {
 		para := r.doc.AddParagraph()
 		r.pushPara(&para)
+		level := node.HeadingLevel
+		if 1 > level || 6 < level {
+			level = 3
+		}
+		// 标题格式由标题样式决定
+		para.SetStyle(r.styleID("Heading" + strconv.Itoa(level)))
 		run := para.AddRun()
 		r.pushRun(&run)
-		props := run.Properties()
-		props.SetBold(true)
-
-		switch node.HeadingLevel {
-		case 1:
-			props.SetSize(measurement.Distance(r.heading1Size))
-			props.SetStyle("Heading1")
-		case 2:
-			props.SetSize(measurement.Distance(r.heading2Size))
-			props.SetStyle("Heading2")
-		case 3:
-			props.SetSize(measurement.Distance(r.heading3Size))
-			props.SetStyle("Heading3")
-		case 4:
-			props.SetSize(measurement.Distance(r.heading4Size))
-			props.SetStyle("Heading4")
-		case 5:
-			props.SetSize(measurement.Distance(r.heading5Size))
-			props.SetStyle("Heading5")
-		case 6:
-			props.SetSize(measurement.Distance(r.heading6Size))
-			props.SetStyle("Heading6")
-		default:
-			props.SetSize(measurement.Distance(r.heading3Size))
-			props.SetStyle("Heading3")
-		}
 	} else {
 		r.popPara()
 		r.popRun()
@@ -1110,60 +1148,6 @@ func (r *DocxRenderer) Newline() {
 	}
 }
 
-func (r *DocxRenderer) downloadImg(src string) (localPath string, ok, isTemp bool) {
-	if strings.HasPrefix(src, "//") {
-		src = "https:" + src
-	}
-
-	u, err := url.Parse(src)
-	if nil != err {
-		logger.Infof("image src [%s] is not an valid URL, treat it as local path", src)
-		return src, true, false
-	}
-
-	if !strings.HasPrefix(u.Scheme, "http") {
-		logger.Infof("image src [%s] scheme is not [http] or [https], treat it as local path", src)
-		return src, true, false
-	}
-
-	src = r.qiniuImgProcessing(src)
-	u, _ = url.Parse(src)
-
-	client := http.Client{
-		Timeout: 5 * time.Second,
-	}
-	req := &http.Request{
-		Header: http.Header{
-			"User-Agent": []string{"Lute-DOCX; +https://github.com/88250/lute-docx"},
-		},
-		URL: u,
-	}
-	resp, err := client.Do(req)
-	if nil != err {
-		logger.Warnf("download image [%s] failed: %s", src, err)
-		return src, false, false
-	}
-	defer resp.Body.Close()
-	if 200 != resp.StatusCode {
-		logger.Warnf("download image [%s] failed, status code is [%d]", src, resp.StatusCode)
-		return src, false, false
-	}
-
-	data, err := ioutil.ReadAll(resp.Body)
-	file, err := ioutil.TempFile("", "lute-docx.img.")
-	if nil != err {
-		logger.Warnf("create temp image [%s] failed: %s", src, err)
-		return src, false, false
-	}
-	_, err = file.Write(data)
-	if nil != err {
-		logger.Warnf("write temp image [%s] failed: %s", src, err)
-		return src, false, false
-	}
-	file.Close()
-	return file.Name(), true, true
-}
-
 // qiniuImgProcessing 七牛云图片样式处理。
 func (r *DocxRenderer) qiniuImgProcessing(src string) string {
 	if !strings.Contains(src, "img.hacpai.com") && !strings.Contains(src, "b3logfile.com") && !strings.Contains(src, "imageView") {
@@ -1180,33 +1164,3 @@ func (r *DocxRenderer) qiniuImgProcessing(src string) string {
 	//src += "?" + style
 	return src
 }
-
-func (r *DocxRenderer) getImgSize(imgPath string) (width, height float64) {
-	file, err := os.Open(imgPath)
-	if nil != err {
-		logger.Fatal(err)
-	}
-	img, _, err := image.Decode(file)
-	if nil != err {
-		logger.Fatal(err)
-	}
-	file.Close()
-
-	imageRect := img.Bounds()
-	k := 1
-	w := -128
-	h := -128
-	if w < 0 {
-		w = -imageRect.Dx() * 72 / w / k
-	}
-	if h < 0 {
-		h = -imageRect.Dy() * 72 / h / k
-	}
-	if w == 0 {
-		w = h * imageRect.Dx() / imageRect.Dy()
-	}
-	if h == 0 {
-		h = w * imageRect.Dy() / imageRect.Dx()
-	}
-	return float64(w), float64(h)
-}
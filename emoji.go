@@ -0,0 +1,174 @@
+// Lute DOCX - 一款将 Markdown 文本转换为 Word 文档 (.docx) 的小工具
+// Copyright (c) 2020-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/88250/lute/ast"
+	"github.com/88250/lute/util"
+	"github.com/unidoc/unioffice/measurement"
+)
+
+// emojiImgSrcRegexp 用于从自定义 Emoji 的 <img> 标签中提取图片地址。
+var emojiImgSrcRegexp = regexp.MustCompile(`src="([^"]+)"`)
+
+func (r *DocxRenderer) renderEmoji(node *ast.Node, entering bool) ast.WalkStatus {
+	return ast.WalkContinue
+}
+
+// renderEmojiUnicode 使用 Emoji 字体将 Unicode Emoji 渲染为单独的文本块。
+func (r *DocxRenderer) renderEmojiUnicode(node *ast.Node, entering bool) ast.WalkStatus {
+	if entering {
+		r.renderEmojiText(util.BytesToStr(node.Tokens))
+	}
+	return ast.WalkSkipChildren
+}
+
+// renderTextWithEmojis 渲染文本 text，其中的 Unicode Emoji 使用 Emoji 字体渲染。
+//
+// 只需要扫描一遍文本：对每个字符按照首字符查找候选 Emoji，候选 Emoji 按照长度降序匹配，保证组合 Emoji 优先于其组成部分。
+func (r *DocxRenderer) renderTextWithEmojis(text string) {
+	emojis := r.emojiIndex()
+	start := 0
+	for i := 0; i < len(text); {
+		c, size := utf8.DecodeRuneInString(text[i:])
+		emoji := ""
+		for _, candidate := range emojis[c] {
+			if strings.HasPrefix(text[i:], candidate) {
+				emoji = candidate
+				break
+			}
+		}
+		if "" == emoji {
+			i += size
+			continue
+		}
+		end := i + len(emoji)
+		for end < len(text) {
+			m, mSize := utf8.DecodeRuneInString(text[end:])
+			if !isEmojiModifier(m) {
+				break
+			}
+			end += mSize
+		}
+		if start < i {
+			r.WriteString(text[start:i])
+		}
+		r.renderEmojiText(text[i:end])
+		i = end
+		start = i
+	}
+	if start < len(text) {
+		r.WriteString(text[start:])
+	}
+}
+
+// isEmojiModifier 判断字符 c 是否是跟在 Emoji 后的肤色修饰符或者变体选择符。
+func isEmojiModifier(c rune) bool {
+	return (0x1F3FB <= c && 0x1F3FF >= c) || 0xFE0F == c
+}
+
+// emojiIndex 返回 Emoji 首字符到以该字符开头的 Emoji 的映射，Emoji 取自解析选项中的 EmojiAlias。
+func (r *DocxRenderer) emojiIndex() map[rune][]string {
+	if nil != r.emojis {
+		return r.emojis
+	}
+
+	r.emojis = map[rune][]string{}
+	for emoji := range r.Tree.Context.ParseOption.EmojiAlias {
+		if strings.Contains(emoji, "/") {
+			// 跳过自定义图片 Emoji，比如 ${emojiSite}/huaji.gif
+			continue
+		}
+		c, _ := utf8.DecodeRuneInString(emoji)
+		r.emojis[c] = append(r.emojis[c], emoji)
+	}
+	for _, candidates := range r.emojis {
+		sort.Slice(candidates, func(i, j int) bool { return len(candidates[i]) > len(candidates[j]) })
+	}
+	return r.emojis
+}
+
+// renderEmojiText 使用 Emoji 字体将 Emoji 文本 emoji 渲染为单独的文本块，Emoji 及其后的文本沿用当前文本块的格式。
+func (r *DocxRenderer) renderEmojiText(emoji string) {
+	if "" == emoji {
+		return
+	}
+
+	run := r.insertRun()
+	if "" != r.emojiFont {
+		setFonts(run.Properties().X(), &DocxFonts{Latin: r.emojiFont, EastAsia: r.emojiFont, CS: r.emojiFont})
+	}
+	run.AddText(emoji)
+	r.LastOut = emoji[len(emoji)-1]
+}
+
+// renderEmojiImg 将自定义 Emoji 渲染为高度和行高一致的行内图片，图片加载失败时渲染 Emoji 别名。
+func (r *DocxRenderer) renderEmojiImg(node *ast.Node, entering bool) ast.WalkStatus {
+	if !entering {
+		return ast.WalkContinue
+	}
+
+	alias := ""
+	if aliasNode := node.ChildByType(ast.NodeEmojiAlias); nil != aliasNode {
+		alias = util.BytesToStr(aliasNode.Tokens)
+	}
+	if !r.renderEmojiImgInline(node.Tokens, strings.Trim(alias, ":")) {
+		r.WriteString(alias)
+	}
+	return ast.WalkSkipChildren
+}
+
+// renderEmojiImgInline 将 <img> 标签 tokens 中的图片渲染为行内图片，替代文本为 Emoji 别名 alias。
+func (r *DocxRenderer) renderEmojiImgInline(tokens []byte, alias string) bool {
+	matches := emojiImgSrcRegexp.FindSubmatch(tokens)
+	if nil == matches {
+		return false
+	}
+	src := util.BytesToStr(matches[1])
+	data, ok := r.loadImage(src)
+	if !ok {
+		return false
+	}
+
+	imgRef, img, err := r.addImage(data)
+	if nil != err {
+		logger.Warnf("add emoji [%s] failed: %s", shortImageSrc(src), err)
+		return false
+	}
+	inline, err := r.peekRun().AddDrawingInline(imgRef)
+	if nil != err {
+		logger.Warnf("add emoji [%s] failed: %s", shortImageSrc(src), err)
+		return false
+	}
+	height := r.lineHeight
+	if 0 >= height {
+		height = r.fontSize
+	}
+	width := height * float64(img.Size.X) / float64(img.Size.Y)
+	inline.SetSize(measurement.Distance(width), measurement.Distance(height))
+	setImageDescription(inline, alias, "")
+	return true
+}
+
+func (r *DocxRenderer) renderEmojiAlias(node *ast.Node, entering bool) ast.WalkStatus {
+	return ast.WalkContinue
+}
@@ -0,0 +1,70 @@
+// Lute DOCX - 一款将 Markdown 文本转换为 Word 文档 (.docx) 的小工具
+// Copyright (c) 2020-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/88250/lute/parse"
+	"github.com/88250/lute/render"
+)
+
+// emojiBenchmarkMarkdown 返回约 3 MB 的 Markdown，中英文混排，包含标题、强调、代码和引述，夹杂普通 Emoji、组合 Emoji 和带肤色修饰符的 Emoji。
+//
+// 不包含列表和链接，它们的渲染耗时随数量增长较快，会掩盖 Emoji 处理的差异。
+func emojiBenchmarkMarkdown() []byte {
+	section := "## 第一节 😀\n\n" +
+		"Lute DOCX 将 **Markdown** 转换为 Word 文档 😀，支持组合 Emoji 👨‍👩‍👧 和肤色修饰 👍🏽，*其余文本* 保持原样 🎉。\n\n" +
+		"没有 Emoji 的长句，用于模拟普通文档中 Emoji 占比较低的情况，其中包含 `代码 😀` 和 ~~删除线~~。\n\n" +
+		"> 引述中的文本 ❤️ 以及 🚀。\n\n"
+	return []byte(strings.Repeat(section, 3*1024*1024/len(section)))
+}
+
+// benchmarkRenderMarkdown 解析并渲染 markdown，preprocess 不为空时在解析前预处理 markdown。
+func benchmarkRenderMarkdown(b *testing.B, preprocess func(markdown []byte, options *parse.Options) []byte) {
+	markdown := emojiBenchmarkMarkdown()
+	b.SetBytes(int64(len(markdown)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		options := parse.NewOptions()
+		options.ToC = true
+		options.AliasEmoji, options.EmojiAlias = parse.NewEmojis()
+		input := markdown
+		if nil != preprocess {
+			input = preprocess(input, options)
+		}
+		NewDocxRenderer(parse.Parse("", input, options), render.NewOptions()).Render()
+	}
+}
+
+// BenchmarkRenderEmojiReplaceAll 使用之前的方式：解析前对每个 Emoji 在整个 Markdown 上执行一遍 bytes.ReplaceAll，
+// 将 Unicode Emoji 替换为 :别名:，然后解析并渲染。
+func BenchmarkRenderEmojiReplaceAll(b *testing.B) {
+	benchmarkRenderMarkdown(b, func(markdown []byte, options *parse.Options) []byte {
+		for emojiUnicode, emojiAlias := range options.EmojiAlias {
+			markdown = bytes.ReplaceAll(markdown, []byte(emojiUnicode), []byte(":"+emojiAlias+":"))
+		}
+		return markdown
+	})
+}
+
+// BenchmarkRenderEmojiSinglePass 使用现在的方式：直接解析并渲染，渲染文本时一遍扫描匹配 Unicode Emoji。
+func BenchmarkRenderEmojiSinglePass(b *testing.B) {
+	benchmarkRenderMarkdown(b, nil)
+}
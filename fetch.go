@@ -0,0 +1,301 @@
+// Lute DOCX - 一款将 Markdown 文本转换为 Word 文档 (.docx) 的小工具
+// Copyright (c) 2020-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"html"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/88250/lute/ast"
+	"github.com/88250/lute/util"
+)
+
+// defaultImageWorkers 描述了默认的并发下载图片数。
+const defaultImageWorkers = 8
+
+// errOffline 描述了离线模式下图片不在缓存中的错误。
+var errOffline = errors.New("not in cache in offline mode")
+
+// loadImage 返回图片 src 的内容，优先使用预下载的结果，否则通过图片解析器获取，远程图片会使用图片缓存。
+func (r *DocxRenderer) loadImage(src string) (data []byte, ok bool) {
+	src = normalizeImageSrc(src)
+	if data, fetched := r.fetched[src]; fetched {
+		return data, nil != data
+	}
+
+	data, err := r.fetchImage(src)
+	if nil != err {
+		if ErrImageNotResolved == err {
+			logger.Warnf("image [%s] not found", shortImageSrc(src))
+		} else {
+			logger.Warnf("load image [%s] failed: %s", shortImageSrc(src), err)
+		}
+	}
+	if nil != r.fetched {
+		r.fetched[src] = data
+	}
+	return data, nil == err
+}
+
+// prefetchImages 收集文档和封面中的所有远程图片地址，按照 ImageWorkers 并发下载，同一个地址只下载一次。
+func (r *DocxRenderer) prefetchImages() {
+	if nil != r.fetched {
+		return
+	}
+	r.fetched = map[string][]byte{}
+
+	srcs := r.remoteImageSrcs()
+	if 1 > len(srcs) {
+		return
+	}
+	workers := r.ImageWorkers
+	if 1 > workers {
+		workers = defaultImageWorkers
+	}
+	if workers > len(srcs) {
+		workers = len(srcs)
+	}
+
+	srcChan := make(chan string)
+	mutex := sync.Mutex{}
+	waitGroup := sync.WaitGroup{}
+	for i := 0; i < workers; i++ {
+		waitGroup.Add(1)
+		go func() {
+			defer waitGroup.Done()
+			for src := range srcChan {
+				data, err := r.fetchImage(src)
+				if nil != err {
+					logger.Warnf("download image [%s] failed: %s", src, err)
+				}
+				mutex.Lock()
+				r.fetched[src] = data
+				mutex.Unlock()
+			}
+		}()
+	}
+	for _, src := range srcs {
+		srcChan <- src
+	}
+	close(srcChan)
+	waitGroup.Wait()
+}
+
+// remoteImageSrcs 返回文档和封面中去重后的远程图片地址，包括 Markdown 图片、自定义 Emoji 和 HTML 图片标签。
+func (r *DocxRenderer) remoteImageSrcs() (ret []string) {
+	added := map[string]bool{}
+	add := func(src string) {
+		src = normalizeImageSrc(src)
+		if isRemoteImage(src) && !added[src] {
+			added[src] = true
+			ret = append(ret, src)
+		}
+	}
+
+	if nil != r.Cover && "" != r.Cover.LogoLink {
+		add(r.Cover.LogoLink)
+	}
+	ast.Walk(r.Tree.Root, func(n *ast.Node, entering bool) ast.WalkStatus {
+		if !entering {
+			return ast.WalkContinue
+		}
+		switch n.Type {
+		case ast.NodeImage:
+			if dest := n.ChildByType(ast.NodeLinkDest); nil != dest {
+				add(util.BytesToStr(dest.Tokens))
+			}
+		case ast.NodeEmojiImg:
+			if matches := emojiImgSrcRegexp.FindSubmatch(n.Tokens); nil != matches {
+				add(util.BytesToStr(matches[1]))
+			}
+		case ast.NodeInlineHTML, ast.NodeHTMLBlock:
+			for _, img := range imgTagsRegexp.FindAllString(util.BytesToStr(n.Tokens), -1) {
+				for _, attr := range parseAttrs(img[len("<img"):]) {
+					if "src" == strings.ToLower(attr[0]) {
+						add(html.UnescapeString(attr[1]))
+					}
+				}
+			}
+		}
+		return ast.WalkContinue
+	})
+	return
+}
+
+// fetchImage 获取图片 src 的内容，data URI 直接解码，其他图片通过 resolveImage 获取。Word 不支持的图片格式会通过
+// convertImage 转换。
+func (r *DocxRenderer) fetchImage(src string) (data []byte, err error) {
+	if isDataURI(src) {
+		data, err = decodeDataURI(src)
+	} else {
+		data, err = r.resolveImage(src)
+	}
+	if nil != err {
+		return nil, err
+	}
+	return convertImage(data)
+}
+
+// resolveImage 通过图片解析器获取图片 src 的内容。
+//
+// 设置了 ImageCacheDir 时远程图片优先使用缓存，下载的图片也会保存到缓存中；离线模式下远程图片只使用缓存。
+// 图片解析器实现了 ImagePolicy 时，使用缓存前先按照解析器的策略检查图片地址（离线模式下不解析域名），并使用解析器给出的缓存键。
+func (r *DocxRenderer) resolveImage(src string) ([]byte, error) {
+	resolver := r.imageResolver()
+	remote := isRemoteImage(src)
+	resolveSrc, cacheKey := src, src
+	if remote {
+		if policy, ok := resolver.(ImagePolicy); ok {
+			if err := policy.Check(src, !r.Offline); nil != err {
+				return nil, err
+			}
+			cacheKey = policy.CacheKey(src)
+		}
+		if data, ok := r.cachedImage(cacheKey); ok {
+			return data, nil
+		}
+		if r.Offline {
+			return nil, errOffline
+		}
+		resolveSrc = r.qiniuImgProcessing(src)
+	}
+
+	data, _, err := resolver.Resolve(resolveSrc)
+	if nil != err {
+		return nil, err
+	}
+	if remote && "" != r.ImageCacheDir {
+		if err = r.cacheImage(cacheKey, data); nil != err {
+			logger.Warnf("cache image [%s] failed: %s", src, err)
+		}
+	}
+	return data, nil
+}
+
+// imageResolver 返回渲染使用的图片解析器，没有设置 ImageResolver 时依次使用本地文件和 HTTP 图片解析器。
+func (r *DocxRenderer) imageResolver() ImageResolver {
+	if nil != r.ImageResolver {
+		return r.ImageResolver
+	}
+	r.resolverOnce.Do(func() {
+		r.resolver = ChainImageResolver{
+			&FileImageResolver{BaseDir: r.BaseDir, SearchPaths: r.SearchPaths, Restrict: r.RestrictLocal},
+			&HTTPImageResolver{},
+		}
+	})
+	return r.resolver
+}
+
+// cachedImage 返回图片缓存中缓存键为 key 的图片的内容，缓存键通常是图片地址。
+//
+// 缓存按照内容寻址：图片保存在 objects/<内容哈希前两位>/<内容哈希>，缓存键到内容哈希的映射保存在 urls/<缓存键哈希>。
+// 映射的修改时间超过 ImageCacheTTL 时视为过期，需要重新下载；离线模式下过期的缓存仍然可以使用。
+func (r *DocxRenderer) cachedImage(key string) ([]byte, bool) {
+	if "" == r.ImageCacheDir {
+		return nil, false
+	}
+	urlPath := filepath.Join(r.ImageCacheDir, "urls", sha256Hex([]byte(key)))
+	if 0 < r.ImageCacheTTL && !r.Offline {
+		info, err := os.Stat(urlPath)
+		if nil != err || time.Since(info.ModTime()) > r.ImageCacheTTL {
+			return nil, false
+		}
+	}
+	hash, err := ioutil.ReadFile(urlPath)
+	if nil != err {
+		return nil, false
+	}
+	data, err := ioutil.ReadFile(r.cacheObjectPath(strings.TrimSpace(string(hash))))
+	if nil != err {
+		return nil, false
+	}
+	return data, true
+}
+
+// cacheImage 将缓存键为 key 的图片的内容 data 保存到图片缓存中，内容相同的图片只保存一份。
+func (r *DocxRenderer) cacheImage(key string, data []byte) error {
+	hash := sha256Hex(data)
+	if objectPath := r.cacheObjectPath(hash); !fileExists(objectPath) {
+		if err := writeFileAtomic(objectPath, data); nil != err {
+			return err
+		}
+	}
+	return writeFileAtomic(filepath.Join(r.ImageCacheDir, "urls", sha256Hex([]byte(key))), []byte(hash))
+}
+
+// cacheObjectPath 返回内容哈希为 hash 的图片在缓存中的文件路径。
+func (r *DocxRenderer) cacheObjectPath(hash string) string {
+	if 2 > len(hash) {
+		return filepath.Join(r.ImageCacheDir, "objects", hash)
+	}
+	return filepath.Join(r.ImageCacheDir, "objects", hash[:2], hash)
+}
+
+// writeFileAtomic 先写入临时文件再重命名为 name，避免并发写入或者进程中断时留下不完整的文件。
+func writeFileAtomic(name string, data []byte) error {
+	dir := filepath.Dir(name)
+	if err := os.MkdirAll(dir, 0755); nil != err {
+		return err
+	}
+	file, err := ioutil.TempFile(dir, ".tmp.")
+	if nil != err {
+		return err
+	}
+	if _, err = file.Write(data); nil != err {
+		file.Close()
+		os.Remove(file.Name())
+		return err
+	}
+	if err = file.Close(); nil != err {
+		os.Remove(file.Name())
+		return err
+	}
+	if err = os.Rename(file.Name(), name); nil != err {
+		os.Remove(file.Name())
+		return err
+	}
+	return nil
+}
+
+// sha256Hex 返回 data 的 SHA-256 哈希的十六进制表示。
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// normalizeImageSrc 规范化图片地址，省略协议的地址 //example.com/a.png 使用 https。
+func normalizeImageSrc(src string) string {
+	if strings.HasPrefix(src, "//") {
+		return "https:" + src
+	}
+	return src
+}
+
+// isRemoteImage 判断图片地址 src 是否是 HTTP 或者 HTTPS 地址。
+func isRemoteImage(src string) bool {
+	u, err := url.Parse(src)
+	return nil == err && ("http" == u.Scheme || "https" == u.Scheme)
+}
@@ -0,0 +1,266 @@
+// Lute DOCX - 一款将 Markdown 文本转换为 Word 文档 (.docx) 的小工具
+// Copyright (c) 2020-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/88250/lute/ast"
+	"github.com/88250/lute/util"
+	"github.com/unidoc/unioffice"
+	"github.com/unidoc/unioffice/document"
+	"github.com/unidoc/unioffice/schema/soo/wml"
+)
+
+// figureSeq 是图片题注编号使用的 SEQ 域标识，插图目录通过该标识收集题注。
+const figureSeq = "Figure"
+
+// figureRefRegexp 用于匹配图片交叉引用，比如 @fig:arch 或者 [@fig:arch]。
+var figureRefRegexp = regexp.MustCompile(`\[@(fig:[-\w:.]+)\]|@(fig:[-\w:.]*[-\w])`)
+
+// figureImage 返回段落 para 中单独成段的图片，段落中还有其他内容时返回 nil。图片后可以紧跟属性列表。
+func figureImage(para *ast.Node) (ret *ast.Node) {
+	if nil != para.Parent && nil != para.Parent.Parent && ast.NodeList == para.Parent.Parent.Type {
+		return nil
+	}
+
+	for c := para.FirstChild; nil != c; c = c.Next {
+		switch c.Type {
+		case ast.NodeImage:
+			if nil != ret {
+				return nil
+			}
+			ret = c
+		case ast.NodeText:
+			tokens := c.Tokens
+			if nil != ret && ret == c.Previous {
+				if _, end := parseImageIAL(ret); 0 < end {
+					tokens = tokens[end:]
+				}
+			}
+			if 0 < len(bytes.TrimSpace(tokens)) {
+				return nil
+			}
+		case ast.NodeKramdownSpanIAL, ast.NodeSoftBreak:
+		default:
+			return nil
+		}
+	}
+	return
+}
+
+// isLoFParagraph 判断段落 para 是否是插图目录标记 [lof]。
+func isLoFParagraph(para *ast.Node) bool {
+	if nil == para.FirstChild || para.FirstChild != para.LastChild || ast.NodeText != para.FirstChild.Type {
+		return false
+	}
+	return strings.EqualFold("[lof]", strings.TrimSpace(util.BytesToStr(para.FirstChild.Tokens)))
+}
+
+// figureNumbers 返回图片标识到图片编号的映射，用于渲染交叉引用。
+func (r *DocxRenderer) figureNumbers() map[string]int {
+	if nil != r.figureIDs {
+		return r.figureIDs
+	}
+
+	r.figureIDs = map[string]int{}
+	number := 0
+	ast.Walk(r.Tree.Root, func(n *ast.Node, entering bool) ast.WalkStatus {
+		if !entering || ast.NodeParagraph != n.Type {
+			return ast.WalkContinue
+		}
+		img := figureImage(n)
+		if nil == img {
+			return ast.WalkContinue
+		}
+		number++
+		if attrs, _ := parseImageIAL(img); nil != attrs && "" != attrs.ID {
+			if _, ok := r.figureIDs[attrs.ID]; ok {
+				logger.Warnf("duplicated figure id [%s]", attrs.ID)
+			}
+			r.figureIDs[attrs.ID] = number
+		}
+		return ast.WalkSkipChildren
+	})
+	return r.figureIDs
+}
+
+// renderFigure 将单独成段的图片 img 渲染为图，图片居中，图片下方为“图 N：标题”形式的题注。
+//
+// 题注中的编号使用 SEQ 域，在 Word 中可以更新编号；设置了图片标识时，“图 N”会被添加为书签，用于交叉引用。
+func (r *DocxRenderer) renderFigure(img *ast.Node) {
+	r.figureNumbers()
+	r.figures++
+
+	attrs := markdownImageAttrs(img)
+	if "" == attrs.Align {
+		attrs.Align = "center"
+	}
+
+	para := r.doc.AddParagraph()
+	para.Properties().X().KeepNext = wml.NewCT_OnOff()
+	r.pushPara(&para)
+	run := para.AddRun()
+	r.pushRun(&run)
+	src := util.BytesToStr(img.ChildByType(ast.NodeLinkDest).Tokens)
+	r.checkImageAlt(src, attrs)
+	if data, ok := r.loadImage(src); ok {
+		r.renderImageInline(data, src, attrs)
+	}
+	r.popRun()
+	r.popPara()
+
+	caption := r.doc.AddParagraph()
+	caption.SetStyle(r.styleID("Caption"))
+	bookmark := ""
+	if "" != attrs.ID {
+		bookmark = figureBookmark(attrs.ID)
+		r.addBookmarkStart(caption, bookmark)
+	}
+	caption.AddRun().AddText(r.localize("figure") + " ")
+	addField(caption.AddRun(), "SEQ "+figureSeq+` \* ARABIC`, strconv.Itoa(r.figures))
+	if "" != bookmark {
+		r.addBookmarkEnd(caption)
+	}
+	if title := imageTitle(img); "" != title {
+		caption.AddRun().AddText(r.localize("captionSeparator") + title)
+	}
+}
+
+// imageTitle 返回图片节点 img 的标题，没有标题时返回替代文本。
+func imageTitle(img *ast.Node) string {
+	if title := img.ChildByType(ast.NodeLinkTitle); nil != title && 0 < len(title.Tokens) {
+		return util.BytesToStr(title.Tokens)
+	}
+	if text := img.ChildByType(ast.NodeLinkText); nil != text {
+		return util.BytesToStr(text.Tokens)
+	}
+	return ""
+}
+
+// renderFigureRefs 渲染文本 text，其中的图片交叉引用渲染为指向题注书签的 REF 域，域沿用当前文本块的格式，引用不存在的图片时原样输出。
+func (r *DocxRenderer) renderFigureRefs(text string) {
+	if !strings.Contains(text, "@fig:") {
+		r.renderTextWithEmojis(text)
+		return
+	}
+
+	numbers := r.figureNumbers()
+	start := 0
+	for _, match := range figureRefRegexp.FindAllStringSubmatchIndex(text, -1) {
+		var id string
+		if 0 <= match[2] {
+			id = text[match[2]:match[3]]
+		} else {
+			id = text[match[4]:match[5]]
+		}
+		number, ok := numbers[id]
+		if !ok {
+			logger.Warnf("figure [%s] not found", id)
+			continue
+		}
+		r.renderTextWithEmojis(text[start:match[0]])
+		addField(r.insertRun(), "REF "+figureBookmark(id)+` \h`, r.localize("figure")+" "+strconv.Itoa(number))
+		start = match[1]
+	}
+	r.renderTextWithEmojis(text[start:])
+}
+
+// renderLoF 渲染插图目录，插图目录通过 TOC 域收集所有图片题注。
+func (r *DocxRenderer) renderLoF() {
+	para := r.doc.AddParagraph()
+	para.SetStyle(r.styleID("TOCHeading"))
+	para.AddRun().AddText(r.localize("lof"))
+	para = r.doc.AddParagraph()
+	run := para.AddRun()
+	run.AddFieldWithFormatting(`TOC \h \z \c "`+figureSeq+`"`, "", true)
+	r.doc.Settings.SetUpdateFieldsOnOpen(true)
+}
+
+// figureBookmark 返回图片标识 id 对应的书签名。书签名只能包含字母、数字和下划线，以下划线开头的书签在 Word 中是隐藏书签。
+func figureBookmark(id string) string {
+	name := []rune("_")
+	for _, c := range id {
+		if 'a' <= c && 'z' >= c || 'A' <= c && 'Z' >= c || '0' <= c && '9' >= c {
+			name = append(name, c)
+		} else {
+			name = append(name, '_')
+		}
+	}
+	if 40 < len(name) {
+		name = name[:40]
+	}
+	return string(name)
+}
+
+// addBookmarkStart 在段落 para 中添加名称为 name 的书签开始标记，需要和 addBookmarkEnd 配对使用。
+func (r *DocxRenderer) addBookmarkStart(para document.Paragraph, name string) {
+	r.bookmarkID++
+	start := wml.NewCT_Bookmark()
+	start.IdAttr = r.bookmarkID
+	start.NameAttr = name
+	markup := wml.NewEG_RangeMarkupElements()
+	markup.BookmarkStart = start
+	addRangeMarkup(para, markup)
+}
+
+// addBookmarkEnd 在段落 para 中添加最近一个书签的结束标记。
+func (r *DocxRenderer) addBookmarkEnd(para document.Paragraph) {
+	end := wml.NewCT_MarkupRange()
+	end.IdAttr = r.bookmarkID
+	markup := wml.NewEG_RangeMarkupElements()
+	markup.BookmarkEnd = end
+	addRangeMarkup(para, markup)
+}
+
+// addRangeMarkup 在段落 para 末尾添加范围标记 markup。
+func addRangeMarkup(para document.Paragraph, markup *wml.EG_RangeMarkupElements) {
+	runLevel := wml.NewEG_RunLevelElts()
+	runLevel.EG_RangeMarkupElements = append(runLevel.EG_RangeMarkupElements, markup)
+	content := wml.NewEG_ContentRunContent()
+	content.EG_RunLevelElts = append(content.EG_RunLevelElts, runLevel)
+	pc := wml.NewEG_PContent()
+	pc.EG_ContentRunContent = append(pc.EG_ContentRunContent, content)
+	para.X().EG_PContent = append(para.X().EG_PContent, pc)
+}
+
+// addField 在文本块 run 中添加域代码为 code 的域，result 为域结果，在 Word 更新域之前显示。
+func addField(run document.Run, code, result string) {
+	x := run.X()
+	fldChar := func(t wml.ST_FldCharType) {
+		ic := wml.NewEG_RunInnerContent()
+		ic.FldChar = wml.NewCT_FldChar()
+		ic.FldChar.FldCharTypeAttr = t
+		x.EG_RunInnerContent = append(x.EG_RunInnerContent, ic)
+	}
+
+	fldChar(wml.ST_FldCharTypeBegin)
+	ic := wml.NewEG_RunInnerContent()
+	ic.InstrText = wml.NewCT_Text()
+	ic.InstrText.Content = " " + code + " "
+	ic.InstrText.SpaceAttr = unioffice.String("preserve")
+	x.EG_RunInnerContent = append(x.EG_RunInnerContent, ic)
+	fldChar(wml.ST_FldCharTypeSeparate)
+	ic = wml.NewEG_RunInnerContent()
+	ic.T = wml.NewCT_Text()
+	ic.T.Content = result
+	x.EG_RunInnerContent = append(x.EG_RunInnerContent, ic)
+	fldChar(wml.ST_FldCharTypeEnd)
+}
@@ -5,6 +5,12 @@ go 1.14
 require (
 	github.com/88250/gulu v1.1.2
 	github.com/88250/lute v1.7.1-0.20201227150112-460780f34e08
+	github.com/skip2/go-qrcode v0.0.0-20200617195104-da1b6568686e
+	github.com/srwiley/oksvg v0.0.0-20200311192757-870daf9aa564
+	github.com/srwiley/rasterx v0.0.0-20200120212402-85cb7272f5e9
 	github.com/unidoc/unioffice v1.4.0
+	golang.org/x/image v0.0.0-20200927104501-e162460cd6b5
+	golang.org/x/net v0.0.0-20201110031124-69a78807bb2b // indirect
 	golang.org/x/text v0.3.4 // indirect
+	gopkg.in/yaml.v3 v3.0.1
 )
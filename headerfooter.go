@@ -0,0 +1,201 @@
+// Lute DOCX - 一款将 Markdown 文本转换为 Word 文档 (.docx) 的小工具
+// Copyright (c) 2020-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/unidoc/unioffice/document"
+	"github.com/unidoc/unioffice/measurement"
+	"github.com/unidoc/unioffice/schema/soo/wml"
+)
+
+// DocxHeaderFooter 描述了 DOCX 页眉页脚。
+//
+// 模板中可以使用如下占位符：
+//
+//	{page}  当前页码
+//	{pages} 总页数
+//	{title} 当前章节标题（最近的一级标题）
+//
+// 模板中使用 | 分隔时依次为左侧、中间、右侧的内容，比如 "{title}||第 {page} 页 / 共 {pages} 页"，
+// 不分隔时内容居中。
+type DocxHeaderFooter struct {
+	Header     string // 页眉模板，奇偶页不同时为奇数页页眉
+	Footer     string // 页脚模板，奇偶页不同时为奇数页页脚
+	EvenHeader string // 偶数页页眉模板，为空时使用左右镜像后的奇数页页眉
+	EvenFooter string // 偶数页页脚模板，为空时使用左右镜像后的奇数页页脚
+	Mirror     bool   // 是否奇偶页不同（对称打印）
+}
+
+// headerFooterPlaceholderRegexp 用于匹配页眉页脚模板中的占位符。
+var headerFooterPlaceholderRegexp = regexp.MustCompile(`\{(page|pages|title)\}`)
+
+// headerFooterFields 定义了页眉页脚模板占位符对应的域代码。
+var headerFooterFields = map[string]string{
+	"page":  "PAGE",
+	"pages": "NUMPAGES",
+	"title": `STYLEREF "heading 1"`,
+}
+
+// paragraphContainer 描述了可以添加段落的页眉或者页脚。
+type paragraphContainer interface {
+	AddParagraph() document.Paragraph
+}
+
+// setHeaderFooter 为分节 section 设置页眉页脚。
+func (r *DocxRenderer) setHeaderFooter(section document.Section) {
+	hf := r.HeaderFooter
+	if nil == hf {
+		hf = &DocxHeaderFooter{}
+	}
+
+	if nil == r.headers {
+		r.headers = map[wml.ST_HdrFtr]document.Header{}
+		r.footers = map[wml.ST_HdrFtr]document.Footer{}
+		if "" == hf.Footer && nil != r.linkFooter {
+			// 未配置页脚时正文沿用封面生成的原文链接页脚
+			r.footers[wml.ST_HdrFtrDefault] = *r.linkFooter
+		}
+		if "" != hf.Header {
+			header := r.doc.AddHeader()
+			r.renderHeaderFooterTemplate(header, hf.Header)
+			r.headers[wml.ST_HdrFtrDefault] = header
+		}
+		if "" != hf.Footer {
+			footer := r.doc.AddFooter()
+			r.renderHeaderFooterTemplate(footer, hf.Footer)
+			r.footers[wml.ST_HdrFtrDefault] = footer
+		}
+		if hf.Mirror {
+			r.doc.Settings.X().EvenAndOddHeaders = wml.NewCT_OnOff()
+			r.doc.Settings.X().MirrorMargins = wml.NewCT_OnOff()
+			if tpl := evenTemplate(hf.Header, hf.EvenHeader); "" != tpl {
+				header := r.doc.AddHeader()
+				r.renderHeaderFooterTemplate(header, tpl)
+				r.headers[wml.ST_HdrFtrEven] = header
+			}
+			if tpl := evenTemplate(hf.Footer, hf.EvenFooter); "" != tpl {
+				footer := r.doc.AddFooter()
+				r.renderHeaderFooterTemplate(footer, tpl)
+				r.footers[wml.ST_HdrFtrEven] = footer
+			} else if "" == hf.Footer && nil != r.linkFooter {
+				// 奇偶页不同时偶数页也需要沿用原文链接页脚，否则偶数页没有页脚
+				r.footers[wml.ST_HdrFtrEven] = *r.linkFooter
+			}
+		}
+	}
+
+	for _, t := range []wml.ST_HdrFtr{wml.ST_HdrFtrDefault, wml.ST_HdrFtrEven} {
+		if header, ok := r.headers[t]; ok {
+			section.SetHeader(header, t)
+		}
+		if footer, ok := r.footers[t]; ok {
+			section.SetFooter(footer, t)
+		}
+	}
+
+	// 未配置的页眉页脚沿用参考文档中的页眉页脚
+	for _, ref := range r.referenceHdrFtrRefs {
+		if nil != ref.HeaderReference {
+			if _, ok := r.headers[ref.HeaderReference.TypeAttr]; !ok {
+				section.X().EG_HdrFtrReferences = append(section.X().EG_HdrFtrReferences, ref)
+			}
+		}
+		if nil != ref.FooterReference {
+			if _, ok := r.footers[ref.FooterReference.TypeAttr]; !ok {
+				section.X().EG_HdrFtrReferences = append(section.X().EG_HdrFtrReferences, ref)
+			}
+		}
+	}
+}
+
+// setCoverHeaderFooter 为封面分节 section 设置首页不同，并且不显示页眉页脚。
+func (r *DocxRenderer) setCoverHeaderFooter(section document.Section) {
+	section.X().TitlePg = wml.NewCT_OnOff()
+	header := r.doc.AddHeader()
+	header.AddParagraph()
+	footer := r.doc.AddFooter()
+	footer.AddParagraph()
+	// 必须显式引用空白页眉页脚，否则会沿用其他分节的页眉页脚
+	for _, t := range []wml.ST_HdrFtr{wml.ST_HdrFtrFirst, wml.ST_HdrFtrDefault, wml.ST_HdrFtrEven} {
+		section.SetHeader(header, t)
+		section.SetFooter(footer, t)
+	}
+}
+
+// evenTemplate 返回偶数页模板，未指定时将奇数页模板 odd 左右镜像。
+func evenTemplate(odd, even string) string {
+	if "" != even {
+		return even
+	}
+
+	parts := strings.Split(odd, "|")
+	switch len(parts) {
+	case 2:
+		return parts[1] + "|" + parts[0]
+	case 3:
+		return parts[2] + "|" + parts[1] + "|" + parts[0]
+	}
+	return odd
+}
+
+// renderHeaderFooterTemplate 将模板 tpl 渲染到页眉或者页脚 container 中。
+func (r *DocxRenderer) renderHeaderFooterTemplate(container paragraphContainer, tpl string) {
+	para := container.AddParagraph()
+	parts := strings.SplitN(tpl, "|", 3)
+	if 1 == len(parts) {
+		para.Properties().SetAlignment(wml.ST_JcCenter)
+		r.renderHeaderFooterPart(para, parts[0])
+		return
+	}
+
+	textWidth := mm(r.textWidth())
+	if 3 == len(parts) {
+		para.Properties().AddTabStop(textWidth/2, wml.ST_TabJcCenter, wml.ST_TabTlcNone)
+	}
+	para.Properties().AddTabStop(textWidth, wml.ST_TabJcRight, wml.ST_TabTlcNone)
+	for i, part := range parts {
+		if 0 < i {
+			para.AddRun().AddTab()
+		}
+		r.renderHeaderFooterPart(para, part)
+	}
+}
+
+// renderHeaderFooterPart 将模板片段 part 中的文本和占位符渲染到段落 para 中。
+func (r *DocxRenderer) renderHeaderFooterPart(para document.Paragraph, part string) {
+	size := measurement.Distance(r.fontSize - 2)
+	last := 0
+	for _, loc := range headerFooterPlaceholderRegexp.FindAllStringSubmatchIndex(part, -1) {
+		if last < loc[0] {
+			run := para.AddRun()
+			run.Properties().SetSize(size)
+			run.AddText(part[last:loc[0]])
+		}
+		run := para.AddRun()
+		run.Properties().SetSize(size)
+		run.AddField(headerFooterFields[part[loc[2]:loc[3]]])
+		last = loc[1]
+	}
+	if last < len(part) {
+		run := para.AddRun()
+		run.Properties().SetSize(size)
+		run.AddText(part[last:])
+	}
+}
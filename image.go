@@ -0,0 +1,414 @@
+// Lute DOCX - 一款将 Markdown 文本转换为 Word 文档 (.docx) 的小工具
+// Copyright (c) 2020-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"html"
+	"image"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/88250/lute/ast"
+	"github.com/88250/lute/util"
+	"github.com/unidoc/unioffice"
+	"github.com/unidoc/unioffice/common"
+	"github.com/unidoc/unioffice/document"
+	"github.com/unidoc/unioffice/measurement"
+	"github.com/unidoc/unioffice/schema/soo/wml"
+)
+
+// defaultImageDPI 描述了图片中没有记录 DPI 并且没有配置 ImageDPI 时使用的 DPI。
+const defaultImageDPI = 96
+
+// imageAttrs 描述了图片的尺寸和对齐方式属性。
+type imageAttrs struct {
+	Width  string // 宽度，支持 px、%、cm、mm、in 和 pt 单位，没有单位时为 px，百分比相对于栏宽
+	Height string // 高度，单位同宽度，百分比相对于版心高度
+	Align  string // 对齐方式，left、center 或者 right
+	ID     string // 标识，比如 fig:arch，用于图片交叉引用
+	Alt    string // 替代文本，写入图片的 descr 属性
+	Title  string // 标题，写入图片的 title 属性
+}
+
+// newImageAttrs 使用属性名值对 attrs 创建图片属性，忽略不支持的属性。
+func newImageAttrs(attrs [][]string) (ret *imageAttrs) {
+	ret = &imageAttrs{}
+	for _, attr := range attrs {
+		value := strings.TrimSpace(html.UnescapeString(attr[1]))
+		switch strings.ToLower(attr[0]) {
+		case "width":
+			ret.Width = value
+		case "height":
+			ret.Height = value
+		case "align":
+			ret.Align = strings.ToLower(value)
+		case "id":
+			ret.ID = value
+		case "alt":
+			ret.Alt = value
+		case "title":
+			ret.Title = value
+		}
+	}
+	return
+}
+
+// imageIALRegexp 用于匹配紧跟在图片后的属性列表，比如 {width=50%} 或者 Kramdown 的 {: width="50%"}。
+var imageIALRegexp = regexp.MustCompile(`^\{:?([^{}\n]*)\}`)
+
+// attrRegexp 用于匹配属性列表或者 HTML 标签中的属性。
+var attrRegexp = regexp.MustCompile(`([a-zA-Z_:][-a-zA-Z0-9_:.]*)\s*=\s*("[^"]*"|'[^']*'|[^\s"'=<>\x60}]+)`)
+
+// parseAttrs 解析 tokens 中的属性名值对。
+func parseAttrs(tokens string) (ret [][]string) {
+	for _, match := range attrRegexp.FindAllStringSubmatch(tokens, -1) {
+		value := match[2]
+		if 2 <= len(value) && ('"' == value[0] || '\'' == value[0]) {
+			value = value[1 : len(value)-1]
+		}
+		ret = append(ret, []string{match[1], value})
+	}
+	return
+}
+
+// markdownImageAttrs 返回 Markdown 图片节点 node 的属性，替代文本和标题取自图片节点。
+func markdownImageAttrs(node *ast.Node) *imageAttrs {
+	ret := imageNodeAttrs(node)
+	if nil == ret {
+		ret = &imageAttrs{}
+	}
+	if text := node.ChildByType(ast.NodeLinkText); nil != text && 0 < len(text.Tokens) {
+		ret.Alt = util.BytesToStr(text.Tokens)
+	}
+	if title := node.ChildByType(ast.NodeLinkTitle); nil != title && 0 < len(title.Tokens) {
+		ret.Title = util.BytesToStr(title.Tokens)
+	}
+	return ret
+}
+
+// checkImageAlt 在开启了 WarnMissingAlt 并且地址为 src 的图片没有替代文本时输出警告。
+func (r *DocxRenderer) checkImageAlt(src string, attrs *imageAttrs) {
+	if r.WarnMissingAlt && (nil == attrs || "" == strings.TrimSpace(attrs.Alt)) {
+		logger.Warnf("image [%s] has no alt text", shortImageSrc(src))
+	}
+}
+
+// setImageDescription 将替代文本 descr 和标题 title 写入行内图片 inline 的 docPr 中，用于无障碍访问。
+func setImageDescription(inline document.InlineDrawing, descr, title string) {
+	docPr := inline.X().DocPr
+	if nil == docPr {
+		return
+	}
+	if "" != descr {
+		docPr.DescrAttr = unioffice.String(descr)
+	}
+	if "" != title {
+		docPr.TitleAttr = unioffice.String(title)
+	}
+}
+
+// imageIDRegexp 用于匹配属性列表中的标识，比如 {#fig:arch}。
+var imageIDRegexp = regexp.MustCompile(`(?:^|\s)#([^\s#{}=]+)`)
+
+// imageNodeAttrs 返回图片节点 node 的属性，属性来自 Kramdown 行级 IAL 或者紧跟在图片后的属性列表，
+// 后者会从后续文本中移除。
+func imageNodeAttrs(node *ast.Node) *imageAttrs {
+	ret, end := parseImageIAL(node)
+	if 0 < end {
+		node.Next.Tokens = node.Next.Tokens[end:]
+	}
+	return ret
+}
+
+// parseImageIAL 解析图片节点 node 的属性，end 为紧跟在图片后的属性列表在后续文本中的结束位置，没有时为 0。
+func parseImageIAL(node *ast.Node) (ret *imageAttrs, end int) {
+	if 0 < len(node.KramdownIAL) {
+		return newImageAttrs(node.KramdownIAL), 0
+	}
+	next := node.Next
+	if nil == next || ast.NodeText != next.Type {
+		return nil, 0
+	}
+	match := imageIALRegexp.FindSubmatchIndex(next.Tokens)
+	if nil == match {
+		return nil, 0
+	}
+	ial := util.BytesToStr(next.Tokens[match[2]:match[3]])
+	attrs := parseAttrs(ial)
+	id := imageIDRegexp.FindStringSubmatch(ial)
+	if 1 > len(attrs) && nil == id {
+		return nil, 0
+	}
+	ret = newImageAttrs(attrs)
+	if nil != id {
+		ret.ID = id[1]
+	}
+	return ret, match[1]
+}
+
+// imageLengthRegexp 用于匹配图片尺寸属性值，比如 50%、300px、5cm。
+var imageLengthRegexp = regexp.MustCompile(`^([0-9]*\.?[0-9]+)\s*(px|%|cm|mm|in|pt)?$`)
+
+// imageLength 将图片尺寸属性值 value 转换为长度，百分比相对于 base。
+func imageLength(value string, base measurement.Distance) (ret measurement.Distance, ok bool) {
+	matches := imageLengthRegexp.FindStringSubmatch(strings.ToLower(strings.TrimSpace(value)))
+	if nil == matches {
+		if "" != value && "auto" != value {
+			logger.Warnf("unsupported image size [%s]", value)
+		}
+		return 0, false
+	}
+	v, err := strconv.ParseFloat(matches[1], 64)
+	if nil != err || 0 >= v {
+		return 0, false
+	}
+	switch matches[2] {
+	case "%":
+		ret = measurement.Distance(v / 100 * float64(base))
+	case "cm":
+		ret = measurement.Distance(v * measurement.Centimeter)
+	case "mm":
+		ret = measurement.Distance(v * measurement.Millimeter)
+	case "in":
+		ret = measurement.Distance(v * measurement.Inch)
+	case "pt":
+		ret = measurement.Distance(v * measurement.Point)
+	default: // CSS 像素，每英寸 96 像素
+		ret = measurement.Distance(v / 96 * measurement.Inch)
+	}
+	return ret, true
+}
+
+// alignImageParagraph 按照图片属性 attrs 设置图片所在段落 para 的对齐方式。
+func alignImageParagraph(para *document.Paragraph, attrs *imageAttrs) {
+	if nil == attrs {
+		return
+	}
+	switch attrs.Align {
+	case "left":
+		para.Properties().SetAlignment(wml.ST_JcLeft)
+	case "center", "middle":
+		para.Properties().SetAlignment(wml.ST_JcCenter)
+	case "right":
+		para.Properties().SetAlignment(wml.ST_JcRight)
+	}
+}
+
+// imageFromBytes 从图片内容 data 构造图片，只解码图片头获取格式和像素尺寸。
+func imageFromBytes(data []byte) (ret common.Image, err error) {
+	config, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if nil != err {
+		return
+	}
+	if 0 >= config.Width || 0 >= config.Height {
+		err = errors.New("invalid image size")
+		return
+	}
+	ret = common.Image{Size: image.Point{X: config.Width, Y: config.Height}, Format: format, Data: &data}
+	return
+}
+
+// addImage 将图片内容 data 添加到文档中，内容相同的图片只在文档中保存一份，由所有引用它的图片共享。
+func (r *DocxRenderer) addImage(data []byte) (imgRef common.ImageRef, img common.Image, err error) {
+	hash := sha256Hex(data)
+	if embedded, ok := r.media[hash]; ok {
+		return embedded.ref, embedded.img, nil
+	}
+
+	if img, err = imageFromBytes(data); nil != err {
+		return
+	}
+	if imgRef, err = r.doc.AddImage(img); nil != err {
+		return
+	}
+	if nil == r.media {
+		r.media = map[string]mediaImage{}
+	}
+	r.media[hash] = mediaImage{ref: imgRef, img: img}
+	return
+}
+
+// mediaImage 描述了已经添加到文档中的图片。
+type mediaImage struct {
+	ref common.ImageRef // 图片引用
+	img common.Image    // 图片
+}
+
+// imageSize 按照图片 data 中记录的 DPI 计算像素尺寸为 pxWidth x pxHeight 的图片在文档中的宽度和高度，
+// attrs 中设置了尺寸时优先使用，只设置了宽度或者高度时保持宽高比。超出栏宽或者最大高度时保持宽高比缩小。
+func (r *DocxRenderer) imageSize(data []byte, pxWidth, pxHeight int, attrs *imageAttrs) (width, height measurement.Distance) {
+	dpiX, dpiY := imageDPI(data)
+	if 0 >= dpiX || 0 >= dpiY {
+		dpiX, dpiY = r.ImageDPI, r.ImageDPI
+		if 0 >= dpiX {
+			dpiX, dpiY = defaultImageDPI, defaultImageDPI
+		}
+	}
+	width = measurement.Distance(float64(pxWidth) / dpiX * measurement.Inch)
+	height = measurement.Distance(float64(pxHeight) / dpiY * measurement.Inch)
+	if 0 >= width || 0 >= height {
+		return
+	}
+
+	maxWidth := mm(r.columnWidth())
+	maxHeight := mm(r.ImageMaxHeight)
+	if 0 >= r.ImageMaxHeight {
+		maxHeight = mm(r.textHeight())
+	}
+	if nil != attrs {
+		w, wOk := imageLength(attrs.Width, maxWidth)
+		h, hOk := imageLength(attrs.Height, mm(r.textHeight()))
+		switch {
+		case wOk && hOk:
+			width, height = w, h
+		case wOk:
+			width, height = w, height*w/width
+		case hOk:
+			width, height = width*h/height, h
+		}
+	}
+	if 0 < maxWidth && width > maxWidth {
+		height = height * maxWidth / width
+		width = maxWidth
+	}
+	if 0 < maxHeight && height > maxHeight {
+		width = width * maxHeight / height
+		height = maxHeight
+	}
+	return
+}
+
+// imageDPI 返回 PNG 图片 pHYs 块或者 JPEG 图片 JFIF 段中记录的水平和垂直 DPI，没有记录时返回 0。
+func imageDPI(data []byte) (x, y float64) {
+	if bytes.HasPrefix(data, []byte("\x89PNG\r\n\x1a\n")) {
+		return pngDPI(data[8:])
+	}
+	if bytes.HasPrefix(data, []byte{0xFF, 0xD8}) {
+		return jpegDPI(data[2:])
+	}
+	return 0, 0
+}
+
+// pngDPI 从 PNG 图片的块 chunks 中读取 pHYs 块记录的 DPI。
+func pngDPI(chunks []byte) (x, y float64) {
+	for 8 <= len(chunks) {
+		length := int(binary.BigEndian.Uint32(chunks[:4]))
+		typ := string(chunks[4:8])
+		if 0 > length || len(chunks) < 12+length {
+			break
+		}
+		chunk := chunks[8 : 8+length]
+		switch typ {
+		case "pHYs":
+			// 单位 1 表示每米像素数
+			if 9 == length && 1 == chunk[8] {
+				x = float64(binary.BigEndian.Uint32(chunk[:4])) * 0.0254
+				y = float64(binary.BigEndian.Uint32(chunk[4:8])) * 0.0254
+			}
+			return
+		case "IDAT", "IEND":
+			return
+		}
+		chunks = chunks[12+length:]
+	}
+	return
+}
+
+// jpegDPI 从 JPEG 图片的段 segments 中读取 JFIF APP0 段记录的 DPI。
+func jpegDPI(segments []byte) (x, y float64) {
+	for 4 <= len(segments) && 0xFF == segments[0] {
+		marker := segments[1]
+		if 0xDA == marker { // 图像数据开始
+			return
+		}
+		length := int(binary.BigEndian.Uint16(segments[2:4]))
+		if 2 > length || len(segments) < 2+length {
+			return
+		}
+		segment := segments[4 : 2+length]
+		if 0xE0 == marker && 12 <= len(segment) && bytes.HasPrefix(segment, []byte("JFIF\x00")) {
+			density := float64(1)
+			switch segment[7] {
+			case 1: // 每英寸像素数
+			case 2: // 每厘米像素数
+				density = 2.54
+			default: // 仅记录了宽高比
+				return
+			}
+			x = float64(binary.BigEndian.Uint16(segment[8:10])) * density
+			y = float64(binary.BigEndian.Uint16(segment[10:12])) * density
+			return
+		}
+		segments = segments[2+length:]
+	}
+	return
+}
+
+// imgTagRegexp 用于匹配 HTML 图片标签。
+var imgTagRegexp = regexp.MustCompile(`(?is)^<img\s[^>]*>$`)
+
+// imgBlockRegexp 用于匹配仅包含图片标签的 HTML 块，图片标签外可以有一层带 align 属性的 p 或者 div 标签。
+var imgBlockRegexp = regexp.MustCompile(`(?is)^(?:<(?:p|div)(\s[^>]*)?>)?\s*((?:<img\s[^>]*>\s*)+)(?:</(?:p|div)>)?$`)
+
+// imgTagsRegexp 用于匹配 HTML 块中的多个图片标签。
+var imgTagsRegexp = regexp.MustCompile(`(?is)<img\s[^>]*>`)
+
+// renderHTMLImageBlock 将仅包含图片标签的 HTML 块 tokens 渲染为图片段落，不是图片块时返回 false。
+func (r *DocxRenderer) renderHTMLImageBlock(tokens []byte) bool {
+	matches := imgBlockRegexp.FindStringSubmatch(strings.TrimSpace(util.BytesToStr(tokens)))
+	if nil == matches {
+		return false
+	}
+
+	para := r.doc.AddParagraph()
+	r.pushPara(&para)
+	run := para.AddRun()
+	r.pushRun(&run)
+	for _, img := range imgTagsRegexp.FindAllString(matches[2], -1) {
+		r.renderHTMLImage(img)
+	}
+	alignImageParagraph(&para, newImageAttrs(parseAttrs(matches[1])))
+	r.popRun()
+	r.popPara()
+	return true
+}
+
+// renderHTMLImage 渲染 HTML 图片标签 tag，支持 src、width、height 和 align 属性。
+func (r *DocxRenderer) renderHTMLImage(tag string) {
+	attrs := parseAttrs(tag[len("<img"):])
+	src := ""
+	for _, attr := range attrs {
+		if "src" == strings.ToLower(attr[0]) {
+			src = html.UnescapeString(attr[1])
+		}
+	}
+	if "" == src {
+		logger.Warnf("image tag [%s] has no src", tag)
+		return
+	}
+	imgAttrs := newImageAttrs(attrs)
+	r.checkImageAlt(src, imgAttrs)
+	data, ok := r.loadImage(src)
+	if !ok {
+		return
+	}
+	r.renderImageInline(data, src, imgAttrs)
+}
@@ -0,0 +1,392 @@
+// Lute DOCX - 一款将 Markdown 文本转换为 Word 文档 (.docx) 的小工具
+// Copyright (c) 2020-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"image"
+	"image/draw"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"math"
+	"net/url"
+	"strings"
+
+	"github.com/srwiley/oksvg"
+	"github.com/srwiley/rasterx"
+	"golang.org/x/image/webp"
+)
+
+const (
+	svgDefaultWidth  = 300  // SVG 图片没有设置尺寸时的默认宽度（像素）
+	svgDefaultHeight = 150  // SVG 图片没有设置尺寸时的默认高度（像素）
+	svgScale         = 2    // SVG 图片栅格化的倍数，按照倍数提高 DPI，保持文档中的尺寸不变
+	svgMaxPixels     = 4096 // SVG 图片栅格化后的最大边长（像素）
+	jpegQuality      = 95   // 按照 EXIF 方向旋转后重新编码 JPEG 图片的质量
+
+	imageMaxPixels = 8192 * 8192 // 需要解码转换的图片的最大像素数，避免很小的图片文件解码时占用大量内存
+)
+
+// isDataURI 判断图片地址 src 是否是 data URI，比如 data:image/png;base64,iVBORw0KGgo...
+func isDataURI(src string) bool {
+	return 5 <= len(src) && strings.EqualFold("data:", src[:5])
+}
+
+// decodeDataURI 解码 data URI src 中的图片内容，支持 Base64 和 URL 编码。
+func decodeDataURI(src string) ([]byte, error) {
+	comma := strings.Index(src, ",")
+	if 0 > comma {
+		return nil, errors.New("invalid data URI")
+	}
+	mediaType, payload := strings.ToLower(src[5:comma]), src[comma+1:]
+	if !strings.HasSuffix(mediaType, ";base64") {
+		payload, err := url.PathUnescape(payload)
+		if nil != err {
+			return nil, err
+		}
+		return []byte(payload), nil
+	}
+
+	payload = strings.Map(func(c rune) rune {
+		if ' ' == c || '\t' == c || '\r' == c || '\n' == c {
+			return -1
+		}
+		return c
+	}, payload)
+	if data, err := base64.StdEncoding.DecodeString(payload); nil == err {
+		return data, nil
+	}
+	return base64.RawStdEncoding.DecodeString(strings.TrimRight(payload, "="))
+}
+
+// shortImageSrc 返回用于日志输出的图片地址，data URI 只保留媒体类型部分。
+func shortImageSrc(src string) string {
+	if !isDataURI(src) {
+		return src
+	}
+	if comma := strings.Index(src, ","); 0 < comma {
+		return src[:comma] + ",..."
+	}
+	return src
+}
+
+// convertImage 将 Word 不支持的图片格式转换为 Word 支持的格式：WebP 和 SVG 转换为 PNG，动图 GIF 使用第一帧，
+// 记录了 EXIF 方向的 JPEG 图片按照方向旋转。不需要转换时返回原图片内容 data。
+func convertImage(data []byte) ([]byte, error) {
+	switch {
+	case bytes.HasPrefix(data, []byte{0xFF, 0xD8}):
+		return orientJPEG(data)
+	case bytes.HasPrefix(data, []byte("GIF8")):
+		return gifFirstFrame(data)
+	case 12 <= len(data) && bytes.HasPrefix(data, []byte("RIFF")) && "WEBP" == string(data[8:12]):
+		config, err := webp.DecodeConfig(bytes.NewReader(data))
+		if nil != err {
+			return nil, err
+		}
+		if err = checkImagePixels(config); nil != err {
+			return nil, err
+		}
+		img, err := webp.Decode(bytes.NewReader(data))
+		if nil != err {
+			return nil, err
+		}
+		return encodePNG(img, 0)
+	case isSVG(data):
+		return rasterizeSVG(data)
+	}
+	return data, nil
+}
+
+// checkImagePixels 检查解码前读取的图片尺寸 config，像素数超过 imageMaxPixels 时返回错误。
+func checkImagePixels(config image.Config) error {
+	if 0 >= config.Width || 0 >= config.Height {
+		return errors.New("invalid image size")
+	}
+	if imageMaxPixels/config.Width < config.Height {
+		return fmt.Errorf("image size [%dx%d] exceeds max pixels [%d]", config.Width, config.Height, imageMaxPixels)
+	}
+	return nil
+}
+
+// isSVG 判断图片内容 data 是否是 SVG 图片。
+func isSVG(data []byte) bool {
+	head := bytes.TrimLeft(data, "\xEF\xBB\xBF \t\r\n")
+	if 1 > len(head) || '<' != head[0] {
+		return false
+	}
+	if 4096 < len(head) {
+		head = head[:4096]
+	}
+	return bytes.Contains(bytes.ToLower(head), []byte("<svg"))
+}
+
+// rasterizeSVG 将 SVG 图片 data 栅格化为 PNG 图片，按照 svgScale 倍栅格化并提高 DPI，保持文档中的尺寸不变。
+func rasterizeSVG(data []byte) ([]byte, error) {
+	icon, err := oksvg.ReadIconStream(bytes.NewReader(data))
+	if nil != err {
+		return nil, err
+	}
+	width, height := icon.ViewBox.W, icon.ViewBox.H
+	if 0 >= width || 0 >= height {
+		width, height = svgDefaultWidth, svgDefaultHeight
+	}
+	scale := math.Min(svgScale, svgMaxPixels/math.Max(width, height))
+	w, h := int(math.Ceil(width*scale)), int(math.Ceil(height*scale))
+	icon.SetTarget(0, 0, float64(w), float64(h))
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	scanner := rasterx.NewScannerGV(w, h, img, img.Bounds())
+	icon.Draw(rasterx.NewDasher(w, h, scanner), 1)
+	return encodePNG(img, defaultImageDPI*scale)
+}
+
+// gifFirstFrame 返回 GIF 动图 data 的第一帧 PNG 图片，不是动图时返回原图片内容。
+//
+// 解码前检查图片尺寸，并且只解码第一帧，避免帧数很多的动图解码时占用大量内存。
+func gifFirstFrame(data []byte) ([]byte, error) {
+	config, err := gif.DecodeConfig(bytes.NewReader(data))
+	if nil != err {
+		return nil, err
+	}
+	if err = checkImagePixels(config); nil != err {
+		return nil, err
+	}
+	if !isAnimatedGIF(data) {
+		return data, nil
+	}
+
+	frame, err := gif.Decode(bytes.NewReader(data))
+	if nil != err {
+		return nil, err
+	}
+	img := image.NewRGBA(image.Rect(0, 0, config.Width, config.Height))
+	draw.Draw(img, frame.Bounds(), frame, frame.Bounds().Min, draw.Over)
+	return encodePNG(img, 0)
+}
+
+// isAnimatedGIF 判断 GIF 图片 data 是否包含多帧。只遍历 GIF 的块结构统计图像描述符，不解码图像数据。
+func isAnimatedGIF(data []byte) bool {
+	if 13 > len(data) {
+		return false
+	}
+	pos := 13 // 文件头和逻辑屏幕描述符
+	if 0 != data[10]&0x80 {
+		pos += 3 << (data[10]&0x07 + 1) // 全局颜色表
+	}
+	// skipSubBlocks 跳过从 pos 开始的数据子块，返回子块后的位置
+	skipSubBlocks := func(pos int) int {
+		for pos < len(data) && 0 != data[pos] {
+			pos += int(data[pos]) + 1
+		}
+		return pos + 1
+	}
+
+	frames := 0
+	for pos < len(data) {
+		switch data[pos] {
+		case 0x21: // 扩展
+			pos = skipSubBlocks(pos + 2)
+		case 0x2C: // 图像描述符
+			if frames++; 1 < frames {
+				return true
+			}
+			if len(data) < pos+10 {
+				return false
+			}
+			flags := data[pos+9]
+			pos += 10
+			if 0 != flags&0x80 {
+				pos += 3 << (flags&0x07 + 1) // 局部颜色表
+			}
+			pos = skipSubBlocks(pos + 1) // LZW 最小编码长度后是图像数据子块
+		default: // 文件结尾 0x3B 或者无法识别的块
+			return false
+		}
+	}
+	return false
+}
+
+// encodePNG 将图片 img 编码为 PNG 图片，dpi 大于 0 时写入记录 DPI 的 pHYs 块。
+func encodePNG(img image.Image, dpi float64) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	if err := png.Encode(buf, img); nil != err {
+		return nil, err
+	}
+	data := buf.Bytes()
+	if 0 >= dpi {
+		return data, nil
+	}
+
+	// pHYs 块需要在 IDAT 块之前，插入到紧跟签名的 IHDR 块后
+	chunk := make([]byte, 21)
+	binary.BigEndian.PutUint32(chunk[:4], 9)
+	copy(chunk[4:8], "pHYs")
+	ppm := uint32(math.Round(dpi / 0.0254))
+	binary.BigEndian.PutUint32(chunk[8:12], ppm)
+	binary.BigEndian.PutUint32(chunk[12:16], ppm)
+	chunk[16] = 1 // 单位为米
+	binary.BigEndian.PutUint32(chunk[17:], crc32.ChecksumIEEE(chunk[4:17]))
+	ihdrEnd := 8 + 12 + 13
+	ret := make([]byte, 0, len(data)+len(chunk))
+	ret = append(ret, data[:ihdrEnd]...)
+	ret = append(ret, chunk...)
+	return append(ret, data[ihdrEnd:]...), nil
+}
+
+// orientJPEG 按照 JPEG 图片 data 中 EXIF 记录的方向旋转图片，没有记录方向或者方向为正常时返回原图片内容。
+func orientJPEG(data []byte) ([]byte, error) {
+	orientation := jpegOrientation(data[2:])
+	if 2 > orientation || 8 < orientation {
+		return data, nil
+	}
+
+	config, err := jpeg.DecodeConfig(bytes.NewReader(data))
+	if nil != err {
+		return nil, err
+	}
+	if err = checkImagePixels(config); nil != err {
+		return nil, err
+	}
+	src, err := jpeg.Decode(bytes.NewReader(data))
+	if nil != err {
+		return nil, err
+	}
+	img := orientImage(src, orientation)
+	buf := &bytes.Buffer{}
+	if err = jpeg.Encode(buf, img, &jpeg.Options{Quality: jpegQuality}); nil != err {
+		return nil, err
+	}
+
+	// 重新编码会丢失 JFIF 中记录的 DPI，需要写回，否则图片在文档中的尺寸会变化；旋转 90 度时交换水平和垂直 DPI
+	dpiX, dpiY := jpegDPI(data[2:])
+	if 0 >= dpiX || 0 >= dpiY {
+		return buf.Bytes(), nil
+	}
+	if 5 <= orientation {
+		dpiX, dpiY = dpiY, dpiX
+	}
+	return insertJFIF(buf.Bytes(), dpiX, dpiY), nil
+}
+
+// insertJFIF 在 JPEG 图片 data 的 SOI 标记后插入记录 DPI 的 JFIF APP0 段。
+func insertJFIF(data []byte, dpiX, dpiY float64) []byte {
+	segment := make([]byte, 18)
+	segment[0], segment[1] = 0xFF, 0xE0
+	binary.BigEndian.PutUint16(segment[2:4], 16)
+	copy(segment[4:9], "JFIF\x00")
+	segment[9], segment[10] = 1, 1 // 版本 1.01
+	segment[11] = 1                // 单位为每英寸像素数
+	binary.BigEndian.PutUint16(segment[12:14], uint16(math.Min(math.Round(dpiX), math.MaxUint16)))
+	binary.BigEndian.PutUint16(segment[14:16], uint16(math.Min(math.Round(dpiY), math.MaxUint16)))
+	ret := make([]byte, 0, len(data)+len(segment))
+	ret = append(ret, data[:2]...)
+	ret = append(ret, segment...)
+	return append(ret, data[2:]...)
+}
+
+// orientImage 按照 EXIF 方向 orientation（2~8）翻转、旋转图片 src。
+func orientImage(src image.Image, orientation int) *image.RGBA {
+	bounds := src.Bounds()
+	rgba := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(rgba, rgba.Bounds(), src, bounds.Min, draw.Src)
+
+	w, h := bounds.Dx(), bounds.Dy()
+	dw, dh := w, h
+	if 5 <= orientation {
+		dw, dh = h, w
+	}
+	ret := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var dx, dy int
+			switch orientation {
+			case 2: // 水平翻转
+				dx, dy = w-1-x, y
+			case 3: // 旋转 180 度
+				dx, dy = w-1-x, h-1-y
+			case 4: // 垂直翻转
+				dx, dy = x, h-1-y
+			case 5: // 沿左上到右下的对角线翻转
+				dx, dy = y, x
+			case 6: // 顺时针旋转 90 度
+				dx, dy = h-1-y, x
+			case 7: // 沿右上到左下的对角线翻转
+				dx, dy = h-1-y, w-1-x
+			case 8: // 逆时针旋转 90 度
+				dx, dy = y, w-1-x
+			}
+			copy(ret.Pix[ret.PixOffset(dx, dy):ret.PixOffset(dx, dy)+4], rgba.Pix[rgba.PixOffset(x, y):rgba.PixOffset(x, y)+4])
+		}
+	}
+	return ret
+}
+
+// jpegOrientation 从 JPEG 图片的段 segments 中读取 EXIF APP1 段记录的方向，没有记录时返回 0。
+func jpegOrientation(segments []byte) int {
+	for 4 <= len(segments) && 0xFF == segments[0] {
+		marker := segments[1]
+		if 0xDA == marker { // 图像数据开始
+			return 0
+		}
+		length := int(binary.BigEndian.Uint16(segments[2:4]))
+		if 2 > length || len(segments) < 2+length {
+			return 0
+		}
+		segment := segments[4 : 2+length]
+		if 0xE1 == marker && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return exifOrientation(segment[6:])
+		}
+		segments = segments[2+length:]
+	}
+	return 0
+}
+
+// exifOrientation 从 EXIF 的 TIFF 数据 tiff 的第一个 IFD 中读取方向标签（0x0112）的值。
+func exifOrientation(tiff []byte) int {
+	if 8 > len(tiff) {
+		return 0
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 0
+	}
+	offset := int(order.Uint32(tiff[4:8]))
+	if 0 > offset || len(tiff) < offset+2 {
+		return 0
+	}
+	count := int(order.Uint16(tiff[offset : offset+2]))
+	for i := 0; i < count; i++ {
+		entry := offset + 2 + i*12
+		if len(tiff) < entry+12 {
+			return 0
+		}
+		if 0x0112 == order.Uint16(tiff[entry:entry+2]) {
+			return int(order.Uint16(tiff[entry+8 : entry+10]))
+		}
+	}
+	return 0
+}
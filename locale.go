@@ -0,0 +1,142 @@
+// Lute DOCX - 一款将 Markdown 文本转换为 Word 文档 (.docx) 的小工具
+// Copyright (c) 2020-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"strings"
+)
+
+// defaultLocale 默认语言环境。
+const defaultLocale = "zh_CN"
+
+// locales 定义了内置的各语言环境下生成文档时使用的文案。
+var locales = map[string]map[string]string{
+	"zh_CN": {
+		"coverAuthor":       "　　作者：",
+		"coverLink":         "原文链接：",
+		"coverSource":       "来源网站：",
+		"coverLicense":      "许可协议：",
+		"coverDate":         "　　日期：",
+		"coverVersion":      "　　版本：",
+		"coverAbstract":     "　　摘要：",
+		"coverOrganization": "　　组织：",
+		"toc":               "目录",
+		"lof":               "插图目录",
+		"figure":            "图",
+		"captionSeparator":  "：",
+	},
+	"zh_TW": {
+		"coverAuthor":       "　　作者：",
+		"coverLink":         "原文連結：",
+		"coverSource":       "來源網站：",
+		"coverLicense":      "授權條款：",
+		"coverDate":         "　　日期：",
+		"coverVersion":      "　　版本：",
+		"coverAbstract":     "　　摘要：",
+		"coverOrganization": "　　組織：",
+		"toc":               "目錄",
+		"lof":               "插圖目錄",
+		"figure":            "圖",
+		"captionSeparator":  "：",
+	},
+	"en_US": {
+		"coverAuthor":       "Author: ",
+		"coverLink":         "Original: ",
+		"coverSource":       "Source: ",
+		"coverLicense":      "License: ",
+		"coverDate":         "Date: ",
+		"coverVersion":      "Version: ",
+		"coverAbstract":     "Abstract: ",
+		"coverOrganization": "Organization: ",
+		"toc":               "Contents",
+		"lof":               "List of Figures",
+		"figure":            "Figure",
+		"captionSeparator":  ": ",
+	},
+	"ja_JP": {
+		"coverAuthor":       "著者：",
+		"coverLink":         "原文リンク：",
+		"coverSource":       "出典：",
+		"coverLicense":      "ライセンス：",
+		"coverDate":         "日付：",
+		"coverVersion":      "バージョン：",
+		"coverAbstract":     "概要：",
+		"coverOrganization": "組織：",
+		"toc":               "目次",
+		"lof":               "図目次",
+		"figure":            "図",
+		"captionSeparator":  "：",
+	},
+}
+
+// normalizeLocale 规范化语言环境名称，比如 zh-cn 规范化为 zh_CN，仅有语言时匹配第一个内置的同语言环境。
+func normalizeLocale(locale string) (ret string, ok bool) {
+	locale = strings.ReplaceAll(strings.TrimSpace(locale), "-", "_")
+	parts := strings.SplitN(locale, "_", 2)
+	lang := strings.ToLower(parts[0])
+	if 2 == len(parts) {
+		ret = lang + "_" + strings.ToUpper(parts[1])
+		_, ok = locales[ret]
+		return
+	}
+
+	for _, candidate := range []string{"zh_CN", "en_US", "ja_JP", "zh_TW"} {
+		if strings.HasPrefix(candidate, lang+"_") {
+			return candidate, true
+		}
+	}
+	return locale, false
+}
+
+// LoadLocaleFile 从 JSON 文件 path 中加载文案，用于覆盖当前语言环境的内置文案，文件内容形如
+// {"toc": "Table of Contents", "figure": "Fig."}。
+func (r *DocxRenderer) LoadLocaleFile(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if nil != err {
+		return err
+	}
+
+	overrides := map[string]string{}
+	if err = json.Unmarshal(data, &overrides); nil != err {
+		return err
+	}
+	if nil == r.LocaleOverrides {
+		r.LocaleOverrides = map[string]string{}
+	}
+	for key, value := range overrides {
+		r.LocaleOverrides[key] = value
+	}
+	return nil
+}
+
+// localize 返回当前语言环境下 key 对应的文案。
+func (r *DocxRenderer) localize(key string) string {
+	if value, ok := r.LocaleOverrides[key]; ok {
+		return value
+	}
+
+	locale, ok := normalizeLocale(r.Locale)
+	if !ok {
+		locale = defaultLocale
+	}
+	if value, ok := locales[locale][key]; ok {
+		return value
+	}
+	return locales[defaultLocale][key]
+}
@@ -21,8 +21,11 @@ import (
 	"flag"
 	"github.com/88250/lute/render"
 	"io/ioutil"
+	"net/http"
 	"os"
+	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/88250/gulu"
 	"github.com/88250/lute/parse"
@@ -35,43 +38,95 @@ func init() {
 }
 
 func main() {
+	if 1 < len(os.Args) && "styles" == os.Args[1] {
+		stylesCommand(os.Args[2:])
+		return
+	}
+
 	argMdPath := flag.String("mdPath", "D:/88250/lute-docx/sample.md", "待转换的 Markdown 文件路径")
 	argSavePath := flag.String("savePath", "D:/88250/lute-docx/sample.docx", "转换后 DOCX 的保存路径")
 
-	argCoverTitle := flag.String("coverTitle", "Lute DOCX - Markdown 生成 DOCX", "封面 - 标题")
-	argCoverAuthor := flag.String("coverAuthor", "88250", "封面 - 作者")
-	argCoverAuthorLink := flag.String("coverAuthorLink", "https://ld246.com/member/88250", "封面 - 作者链接")
-	argCoverLink := flag.String("coverLink", "https://github.com/88250/lute-docx", "封面 - 原文链接")
-	argCoverSource := flag.String("coverSource", "GitHub", "封面 - 来源网站")
-	argCoverSourceLink := flag.String("coverSourceLink", "https://github.com", "封面 - 来源网站链接")
-	argCoverLicense := flag.String("coverLicense", "署名-相同方式共享 4.0 国际 (CC BY-SA 4.0)", "封面 - 文档许可协议")
-	argCoverLicenseLink := flag.String("coverLicenseLink", "https://creativecommons.org/licenses/by-sa/4.0/", "封面 - 文档许可协议链接")
-	argCoverLogoLink := flag.String("coverLogoLink", "https://static.b3log.org/images/brand/b3log-128.png", "封面 - 图标链接")
-	argCoverLogoTitle := flag.String("coverLogoTitle", "B3log 开源", "封面 - 图标标题")
-	argCoverLogoTitleLink := flag.String("coverLogoTitleLink", "https://b3log.org", "封面 - 图标标题链接")
+	argBaseDir := flag.String("baseDir", "", "解析图片和链接相对路径的基础目录，为空时使用 Markdown 文件所在目录")
+	argImagePaths := flag.String("imagePaths", "", "图片搜索路径，多个路径使用系统路径列表分隔符（Windows 为 ;，其他为 :）分隔")
+
+	argImageDPI := flag.Float64("imageDPI", defaultImageDPI, "图片中没有记录 DPI 时使用的 DPI")
+	argImageMaxHeight := flag.Float64("imageMaxHeight", 0, "图片最大高度（毫米），为 0 时使用版心高度")
+
+	argWarnMissingAlt := flag.Bool("warnMissingAlt", false, "图片没有替代文本时是否输出警告")
+
+	argImageCacheDir := flag.String("imageCacheDir", defaultImageCacheDir(), "图片缓存目录，为空时不缓存")
+	argImageCacheTTL := flag.Float64("imageCacheTTL", 24, "图片缓存有效期（小时），过期的图片会重新下载，为 0 时永不过期")
+	argImageWorkers := flag.Int("imageWorkers", defaultImageWorkers, "并发下载图片数")
+	argOffline := flag.Bool("offline", false, "离线模式，只使用图片缓存和本地图片")
+	var argImageHeaders, argImageCookies stringsFlag
+	flag.Var(&argImageHeaders, "imageHeader", "下载图片时附加的请求头，比如 \"Authorization: Bearer xxx\"，可以指定多次")
+	flag.Var(&argImageCookies, "imageCookie", "下载图片时附带的 Cookie，比如 session=xxx，可以指定多次")
+	argImageProxy := flag.String("imageProxy", "", "下载图片使用的代理地址，为空时使用环境变量 HTTP_PROXY、HTTPS_PROXY")
+	argImageTimeout := flag.Float64("imageTimeout", 5, "下载单个图片的超时时间（秒）")
+	argImageRetries := flag.Int("imageRetries", 2, "下载图片失败（网络错误、429 或者 5xx）后的重试次数，重试间隔从 0.5 秒开始每次加倍")
+	argImageMaxSize := flag.Float64("imageMaxSize", 0, "单个图片的最大大小（MB），为 0 时不限制")
+	argImageMaxCount := flag.Int("imageMaxCount", 0, "最多下载的图片数，为 0 时不限制")
+	argImageAllowHosts := flag.String("imageAllowHosts", "", "允许下载图片的主机，多个主机使用 , 分隔，支持 *.example.com 形式的通配，为空时允许所有主机")
+	argImageDenyHosts := flag.String("imageDenyHosts", "", "禁止下载图片的主机，多个主机使用 , 分隔，支持 *.example.com 形式的通配")
+	argServerMode := flag.Bool("serverMode", false, "服务端模式，用于转换不受信任的 Markdown，默认禁止下载内网地址的图片，只允许读取基础目录和图片搜索路径中的本地图片")
+	argBlockPrivateIPs := flag.Bool("blockPrivateIPs", false, "是否禁止下载回环、内网、链路本地等非公网地址的图片，服务端模式下默认开启")
+
+	argReferenceDoc := flag.String("referenceDoc", "", "参考文档 DOCX 文件路径，生成的文档沿用其中的样式、页面设置和页眉页脚")
+
+	argTheme := flag.String("theme", "light", "主题，内置 light、print、dark-accent，也可以是自定义主题文件路径")
+
+	argLocale := flag.String("locale", defaultLocale, "语言环境，支持 zh_CN、zh_TW、en_US 和 ja_JP")
+	argLocaleFile := flag.String("localeFile", "", "用于覆盖内置文案的 JSON 文件路径")
+
+	argCover := flag.Bool("cover", false, "封面 - 是否生成封面，封面字段默认取自 YAML Front Matter，命令行参数优先")
+	flag.String("coverTitle", "", "封面 - 标题")
+	flag.String("coverAuthor", "", "封面 - 作者")
+	flag.String("coverAuthorLink", "", "封面 - 作者链接")
+	flag.String("coverLink", "", "封面 - 原文链接")
+	flag.String("coverSource", "", "封面 - 来源网站")
+	flag.String("coverSourceLink", "", "封面 - 来源网站链接")
+	flag.String("coverLicense", "", "封面 - 文档许可协议")
+	flag.String("coverLicenseLink", "", "封面 - 文档许可协议链接")
+	flag.String("coverLogoLink", "", "封面 - 图标链接")
+	flag.String("coverLogoTitle", "", "封面 - 图标标题")
+	flag.String("coverLogoTitleLink", "", "封面 - 图标标题链接")
+	flag.String("coverDate", "", "封面 - 日期")
+	flag.String("coverVersion", "", "封面 - 版本")
+	flag.String("coverAbstract", "", "封面 - 摘要")
+	flag.String("coverOrganization", "", "封面 - 组织")
+	argCoverLayout := flag.String("coverLayout", "classic", "封面 - 布局，内置 classic、corporate、minimal，也可以是自定义布局文件路径")
+	argCoverQRCode := flag.String("coverQRCode", "", "封面 - 原文链接二维码位置，cover 封面、footer 页脚或者 both 两者，为空时不生成")
+	argCoverQRCodeSize := flag.Float64("coverQRCodeSize", 0, "封面 - 原文链接二维码边长（毫米），为 0 时封面使用 30、页脚使用 15")
+	argCoverQRCodeAlign := flag.String("coverQRCodeAlign", "", "封面 - 原文链接二维码对齐方式，left、center 或者 right")
+	argCoverTemplate := flag.String("coverTemplate", "", "封面 - 模板 DOCX 文件路径，模板中的 {{title}}、{{author}} 等占位符会被替换为封面字段或者 YAML Front Matter 中的值")
+
+	defaultPageSetup := NewDocxPageSetup()
+	argPageSize := flag.String("pageSize", defaultPageSetup.Size, "页面 - 纸张大小，A4、A3、A5、B5、Letter、Legal 或者 Custom")
+	flag.Float64("pageWidth", defaultPageSetup.Width, "页面 - 纸张宽度（毫米），仅在纸张大小为 Custom 时使用")
+	flag.Float64("pageHeight", defaultPageSetup.Height, "页面 - 纸张高度（毫米），仅在纸张大小为 Custom 时使用")
+	argPageOrientation := flag.String("pageOrientation", "portrait", "页面 - 纸张方向，portrait 纵向或者 landscape 横向")
+	flag.Float64("marginTop", defaultPageSetup.MarginTop, "页面 - 上边距（毫米）")
+	flag.Float64("marginRight", defaultPageSetup.MarginRight, "页面 - 右边距（毫米）")
+	flag.Float64("marginBottom", defaultPageSetup.MarginBottom, "页面 - 下边距（毫米）")
+	flag.Float64("marginLeft", defaultPageSetup.MarginLeft, "页面 - 左边距（毫米）")
+	flag.Float64("headerDistance", defaultPageSetup.HeaderDistance, "页面 - 页眉距页面顶端距离（毫米）")
+	flag.Float64("footerDistance", defaultPageSetup.FooterDistance, "页面 - 页脚距页面底端距离（毫米）")
+	argColumns := flag.Int("columns", defaultPageSetup.Columns, "页面 - 分栏数")
+	flag.Float64("columnSpace", defaultPageSetup.ColumnSpace, "页面 - 栏间距（毫米）")
+
+	argHeader := flag.String("header", "", "页眉 - 模板，支持 {page}、{pages}、{title} 占位符，使用 | 分隔左、中、右内容")
+	argFooter := flag.String("footer", "", "页脚 - 模板，支持 {page}、{pages}、{title} 占位符，使用 | 分隔左、中、右内容")
+	argEvenHeader := flag.String("evenHeader", "", "页眉 - 偶数页模板，为空时使用左右镜像后的页眉")
+	argEvenFooter := flag.String("evenFooter", "", "页脚 - 偶数页模板，为空时使用左右镜像后的页脚")
+	argMirror := flag.Bool("mirror", false, "页眉页脚 - 是否奇偶页不同（对称打印）")
 
 	flag.Parse()
 
 	mdPath := trimQuote(*argMdPath)
 	savePath := trimQuote(*argSavePath)
 
-	coverTitle := trimQuote(*argCoverTitle)
-	coverAuthorLabel := "　　作者："
-	coverAuthor := trimQuote(*argCoverAuthor)
-	coverAuthorLink := trimQuote(*argCoverAuthorLink)
-	coverLinkLabel := "原文链接："
-	coverLink := trimQuote(*argCoverLink)
-	coverSourceLabel := "来源网站："
-	coverSource := trimQuote(*argCoverSource)
-	coverSourceLink := trimQuote(*argCoverSourceLink)
-	coverLicenseLabel := "许可协议："
-	coverLicense := trimQuote(*argCoverLicense)
-	coverLicenseLink := trimQuote(*argCoverLicenseLink)
-	coverLogoLink := trimQuote(*argCoverLogoLink)
-	coverLogoTitle := trimQuote(*argCoverLogoTitle)
-	coverLogoTitleLink := trimQuote(*argCoverLogoTitleLink)
-
 	parseOptions := parse.NewOptions()
+	parseOptions.ToC = true
 	parseOptions.AliasEmoji, parseOptions.EmojiAlias = parse.NewEmojis()
 
 	markdown, err := ioutil.ReadFile(mdPath)
@@ -80,31 +135,164 @@ func main() {
 	}
 
 	markdown = bytes.ReplaceAll(markdown, []byte("\t"), []byte("    "))
-	for emojiUnicode, emojiAlias := range parseOptions.EmojiAlias {
-		markdown = bytes.ReplaceAll(markdown, []byte(emojiUnicode), []byte(":"+emojiAlias+":"))
-	}
 
 	tree := parse.Parse("", markdown, parseOptions)
 	renderOptions := render.NewOptions()
-	renderer := NewDocxRenderer(tree, renderOptions)
-	renderer.Cover = &DocxCover{
-		Title:         coverTitle,
-		AuthorLabel:   coverAuthorLabel,
-		Author:        coverAuthor,
-		AuthorLink:    coverAuthorLink,
-		LinkLabel:     coverLinkLabel,
-		Link:          coverLink,
-		SourceLabel:   coverSourceLabel,
-		Source:        coverSource,
-		SourceLink:    coverSourceLink,
-		LicenseLabel:  coverLicenseLabel,
-		License:       coverLicense,
-		LicenseLink:   coverLicenseLink,
-		LogoLink:      coverLogoLink,
-		LogoTitle:     coverLogoTitle,
-		LogoTitleLink: coverLogoTitleLink,
-	}
-	renderer.RenderCover()
+	var renderer *DocxRenderer
+	if referenceDoc := trimQuote(*argReferenceDoc); "" != referenceDoc {
+		if renderer, err = NewDocxRendererWithReferenceDoc(tree, renderOptions, referenceDoc); nil != err {
+			logger.Fatal(err)
+		}
+	} else {
+		renderer = NewDocxRenderer(tree, renderOptions)
+	}
+
+	renderer.BaseDir = trimQuote(*argBaseDir)
+	if "" == renderer.BaseDir {
+		renderer.BaseDir = filepath.Dir(mdPath)
+	}
+	if imagePaths := trimQuote(*argImagePaths); "" != imagePaths {
+		renderer.SearchPaths = filepath.SplitList(imagePaths)
+	}
+	renderer.RestrictLocal = *argServerMode
+	renderer.ImageDPI = *argImageDPI
+	renderer.ImageMaxHeight = *argImageMaxHeight
+	renderer.WarnMissingAlt = *argWarnMissingAlt
+	renderer.ImageCacheDir = trimQuote(*argImageCacheDir)
+	renderer.ImageCacheTTL = time.Duration(*argImageCacheTTL * float64(time.Hour))
+	renderer.ImageWorkers = *argImageWorkers
+	renderer.Offline = *argOffline
+	blockPrivateIPs := *argServerMode
+	flag.Visit(func(f *flag.Flag) {
+		if "blockPrivateIPs" == f.Name {
+			blockPrivateIPs = *argBlockPrivateIPs
+		}
+	})
+	httpResolver := &HTTPImageResolver{
+		Header:          http.Header{},
+		Proxy:           trimQuote(*argImageProxy),
+		Timeout:         time.Duration(*argImageTimeout * float64(time.Second)),
+		Retries:         *argImageRetries,
+		MaxSize:         int64(*argImageMaxSize * 1024 * 1024),
+		MaxCount:        *argImageMaxCount,
+		AllowHosts:      splitList(trimQuote(*argImageAllowHosts)),
+		DenyHosts:       splitList(trimQuote(*argImageDenyHosts)),
+		BlockPrivateIPs: blockPrivateIPs,
+	}
+	for _, header := range argImageHeaders {
+		parts := strings.SplitN(trimQuote(header), ":", 2)
+		if 2 != len(parts) || "" == strings.TrimSpace(parts[0]) {
+			logger.Fatalf("invalid image header [%s]", header)
+		}
+		httpResolver.Header.Add(strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1]))
+	}
+	for _, cookie := range argImageCookies {
+		parts := strings.SplitN(trimQuote(cookie), "=", 2)
+		if 2 != len(parts) || "" == strings.TrimSpace(parts[0]) {
+			logger.Fatalf("invalid image cookie [%s]", cookie)
+		}
+		httpResolver.Cookies = append(httpResolver.Cookies, &http.Cookie{Name: strings.TrimSpace(parts[0]), Value: strings.TrimSpace(parts[1])})
+	}
+	renderer.ImageResolver = ChainImageResolver{
+		// 服务端模式下只允许读取基础目录和图片搜索路径中的图片
+		&FileImageResolver{BaseDir: renderer.BaseDir, SearchPaths: renderer.SearchPaths, Restrict: renderer.RestrictLocal},
+		httpResolver,
+	}
+
+	// 仅使用显式指定的页面参数覆盖页面设置，这样使用参考文档时可以沿用参考文档中的页面设置
+	pageSetup := renderer.PageSetup
+	pageFlags := map[string]*float64{
+		"pageWidth":      &pageSetup.Width,
+		"pageHeight":     &pageSetup.Height,
+		"marginTop":      &pageSetup.MarginTop,
+		"marginRight":    &pageSetup.MarginRight,
+		"marginBottom":   &pageSetup.MarginBottom,
+		"marginLeft":     &pageSetup.MarginLeft,
+		"headerDistance": &pageSetup.HeaderDistance,
+		"footerDistance": &pageSetup.FooterDistance,
+		"columnSpace":    &pageSetup.ColumnSpace,
+	}
+	flag.Visit(func(f *flag.Flag) {
+		if field := pageFlags[f.Name]; nil != field {
+			*field = f.Value.(flag.Getter).Get().(float64)
+			return
+		}
+
+		switch f.Name {
+		case "pageSize":
+			pageSetup.Size = trimQuote(*argPageSize)
+		case "columns":
+			pageSetup.Columns = *argColumns
+		case "pageOrientation":
+			switch strings.ToLower(trimQuote(*argPageOrientation)) {
+			case "portrait":
+				pageSetup.Landscape = false
+			case "landscape":
+				pageSetup.Landscape = true
+			default:
+				logger.Fatalf("unsupported page orientation [%s]", *argPageOrientation)
+			}
+		}
+	})
+	if err := pageSetup.Validate(); nil != err {
+		logger.Fatal(err)
+	}
+	renderer.Theme = loadTheme(trimQuote(*argTheme))
+	locale, ok := normalizeLocale(trimQuote(*argLocale))
+	if !ok {
+		logger.Fatalf("unsupported locale [%s]", *argLocale)
+	}
+	renderer.Locale = locale
+	if localeFile := trimQuote(*argLocaleFile); "" != localeFile {
+		if err := renderer.LoadLocaleFile(localeFile); nil != err {
+			logger.Fatal(err)
+		}
+	}
+	renderer.HeaderFooter = &DocxHeaderFooter{
+		Header:     trimQuote(*argHeader),
+		Footer:     trimQuote(*argFooter),
+		EvenHeader: trimQuote(*argEvenHeader),
+		EvenFooter: trimQuote(*argEvenFooter),
+		Mirror:     *argMirror,
+	}
+	if *argCover {
+		cover := &DocxCover{}
+		cover.SetFrontMatter(renderer.FrontMatter())
+		coverFlags := map[string]*string{
+			"coverTitle":         &cover.Title,
+			"coverAuthor":        &cover.Author,
+			"coverAuthorLink":    &cover.AuthorLink,
+			"coverLink":          &cover.Link,
+			"coverSource":        &cover.Source,
+			"coverSourceLink":    &cover.SourceLink,
+			"coverLicense":       &cover.License,
+			"coverLicenseLink":   &cover.LicenseLink,
+			"coverLogoLink":      &cover.LogoLink,
+			"coverLogoTitle":     &cover.LogoTitle,
+			"coverLogoTitleLink": &cover.LogoTitleLink,
+			"coverDate":          &cover.Date,
+			"coverVersion":       &cover.Version,
+			"coverAbstract":      &cover.Abstract,
+			"coverOrganization":  &cover.Organization,
+		}
+		flag.Visit(func(f *flag.Flag) {
+			if field := coverFlags[f.Name]; nil != field {
+				*field = trimQuote(f.Value.String())
+			}
+		})
+		coverLayout := trimQuote(*argCoverLayout)
+		if layout, ok := CoverLayout(coverLayout); ok {
+			cover.Layout = layout
+		} else if cover.Layout, err = LoadCoverLayout(coverLayout); nil != err {
+			logger.Fatal(err)
+		}
+		cover.Template = trimQuote(*argCoverTemplate)
+		cover.QRCode = trimQuote(*argCoverQRCode)
+		cover.QRCodeSize = *argCoverQRCodeSize
+		cover.QRCodeAlign = trimQuote(*argCoverQRCodeAlign)
+		renderer.Cover = cover
+		renderer.RenderCover()
+	}
 
 	renderer.Render()
 	renderer.Save(savePath)
@@ -112,6 +300,60 @@ func main() {
 	logger.Info("completed")
 }
 
+// stylesCommand 执行 styles 子命令：lute-docx styles --out reference.docx，导出内置样式参考文档。
+func stylesCommand(args []string) {
+	flagSet := flag.NewFlagSet("styles", flag.ExitOnError)
+	argOut := flagSet.String("out", "reference.docx", "导出的样式参考文档保存路径")
+	argTheme := flagSet.String("theme", "light", "主题，内置 light、print、dark-accent，也可以是自定义主题文件路径")
+	flagSet.Parse(args)
+
+	ExportStyles(trimQuote(*argOut), loadTheme(trimQuote(*argTheme)))
+	logger.Info("completed")
+}
+
+// defaultImageCacheDir 返回默认的图片缓存目录，即用户缓存目录下的 lute-docx/images。
+func defaultImageCacheDir() string {
+	dir, err := os.UserCacheDir()
+	if nil != err {
+		return ""
+	}
+	return filepath.Join(dir, "lute-docx", "images")
+}
+
+// loadTheme 返回名称为 name 的内置主题，不是内置主题时从文件 name 中加载。
+func loadTheme(name string) *DocxTheme {
+	if theme, ok := Theme(name); ok {
+		return theme
+	}
+	theme, err := LoadTheme(name)
+	if nil != err {
+		logger.Fatal(err)
+	}
+	return theme
+}
+
 func trimQuote(str string) string {
 	return strings.Trim(str, "\"'")
 }
+
+// splitList 按照 , 分隔 str 并去掉空白项。
+func splitList(str string) (ret []string) {
+	for _, item := range strings.Split(str, ",") {
+		if item = strings.TrimSpace(item); "" != item {
+			ret = append(ret, item)
+		}
+	}
+	return
+}
+
+// stringsFlag 描述了可以指定多次的字符串命令行参数。
+type stringsFlag []string
+
+func (f *stringsFlag) String() string {
+	return strings.Join(*f, ", ")
+}
+
+func (f *stringsFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
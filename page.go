@@ -0,0 +1,314 @@
+// Lute DOCX - 一款将 Markdown 文本转换为 Word 文档 (.docx) 的小工具
+// Copyright (c) 2020-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/88250/lute/ast"
+	"github.com/unidoc/unioffice"
+	"github.com/unidoc/unioffice/document"
+	"github.com/unidoc/unioffice/measurement"
+	"github.com/unidoc/unioffice/schema/soo/ofc/sharedTypes"
+	"github.com/unidoc/unioffice/schema/soo/wml"
+)
+
+// DocxPageSetup 描述了 DOCX 页面设置。
+type DocxPageSetup struct {
+	Size           string  // 纸张大小，A4、A3、A5、B5、Letter、Legal 或者 Custom
+	Width          float64 // 纸张宽度（毫米），仅在纸张大小为 Custom 时使用
+	Height         float64 // 纸张高度（毫米），仅在纸张大小为 Custom 时使用
+	Landscape      bool    // 是否横向
+	MarginTop      float64 // 上边距（毫米）
+	MarginRight    float64 // 右边距（毫米）
+	MarginBottom   float64 // 下边距（毫米）
+	MarginLeft     float64 // 左边距（毫米）
+	HeaderDistance float64 // 页眉距页面顶端距离（毫米）
+	FooterDistance float64 // 页脚距页面底端距离（毫米）
+	Columns        int     // 分栏数
+	ColumnSpace    float64 // 栏间距（毫米）
+}
+
+// pageSizes 定义了支持的纸张大小（纵向宽、高，单位毫米）。
+var pageSizes = map[string][2]float64{
+	"a3":     {297, 420},
+	"a4":     {210, 297},
+	"a5":     {148, 210},
+	"b5":     {182, 257}, // JIS B5，和 Word 中的 B5 一致
+	"letter": {215.9, 279.4},
+	"legal":  {215.9, 355.6},
+}
+
+// NewDocxPageSetup 创建一个默认的页面设置：A4 纵向，上下左右边距均为 25.4 毫米。
+func NewDocxPageSetup() *DocxPageSetup {
+	return &DocxPageSetup{
+		Size:           "A4",
+		MarginTop:      25.4,
+		MarginRight:    25.4,
+		MarginBottom:   25.4,
+		MarginLeft:     25.4,
+		HeaderDistance: 12.7,
+		FooterDistance: 12.7,
+		Columns:        1,
+		ColumnSpace:    12.7,
+	}
+}
+
+// PageSize 返回考虑了纸张方向后的页面宽度和高度（毫米）。
+func (setup *DocxPageSetup) PageSize() (width, height float64, err error) {
+	if "custom" == strings.ToLower(setup.Size) {
+		if 0 >= setup.Width || 0 >= setup.Height {
+			return 0, 0, fmt.Errorf("invalid custom page size [%vx%v]", setup.Width, setup.Height)
+		}
+		width, height = setup.Width, setup.Height
+	} else {
+		size, ok := pageSizes[strings.ToLower(setup.Size)]
+		if !ok {
+			return 0, 0, fmt.Errorf("unsupported page size [%s]", setup.Size)
+		}
+		width, height = size[0], size[1]
+	}
+	if setup.Landscape {
+		width, height = height, width
+	}
+	return
+}
+
+// Validate 检查页面设置：纸张大小需要受支持，边距、页眉页脚距离和栏间距不能为负数，左右、上下边距之和需要小于纸张宽度、高度，
+// 分栏后每栏的宽度需要大于 0。
+func (setup *DocxPageSetup) Validate() error {
+	width, height, err := setup.PageSize()
+	if nil != err {
+		return err
+	}
+
+	lengths := []struct {
+		name  string
+		value float64
+	}{
+		{"top margin", setup.MarginTop},
+		{"right margin", setup.MarginRight},
+		{"bottom margin", setup.MarginBottom},
+		{"left margin", setup.MarginLeft},
+		{"header distance", setup.HeaderDistance},
+		{"footer distance", setup.FooterDistance},
+		{"column space", setup.ColumnSpace},
+	}
+	for _, length := range lengths {
+		if 0 > length.value {
+			return fmt.Errorf("invalid %s [%v], must not be negative", length.name, length.value)
+		}
+	}
+	if setup.MarginLeft+setup.MarginRight >= width {
+		return fmt.Errorf("left margin [%v] and right margin [%v] must be smaller than page width [%v]", setup.MarginLeft, setup.MarginRight, width)
+	}
+	if setup.MarginTop+setup.MarginBottom >= height {
+		return fmt.Errorf("top margin [%v] and bottom margin [%v] must be smaller than page height [%v]", setup.MarginTop, setup.MarginBottom, height)
+	}
+	if 1 > setup.Columns {
+		return fmt.Errorf("invalid columns [%d]", setup.Columns)
+	}
+	if textWidth := width - setup.MarginLeft - setup.MarginRight; 0 >= textWidth-setup.ColumnSpace*float64(setup.Columns-1) {
+		return fmt.Errorf("column space [%v] is too large for [%d] columns", setup.ColumnSpace, setup.Columns)
+	}
+	return nil
+}
+
+// directiveRegexp 用于匹配 HTML 注释形式的排版指令，比如 <!-- columns: 2 -->。
+var directiveRegexp = regexp.MustCompile(`^<!--\s*(/?[a-zA-Z]+)\s*:?\s*(.*?)\s*-->$`)
+
+// parseDirective 解析 HTML 注释形式的排版指令，返回指令名和参数。
+func parseDirective(tokens []byte) (name, arg string, ok bool) {
+	matches := directiveRegexp.FindStringSubmatch(strings.TrimSpace(string(tokens)))
+	if nil == matches {
+		return "", "", false
+	}
+	return strings.ToLower(matches[1]), matches[2], true
+}
+
+// renderDirective 渲染排版指令，如果 tokens 不是支持的指令则返回 false。
+//
+//	<!-- columns -->     按页面设置中的分栏数开始分栏
+//	<!-- columns: 3 -->  开始三栏分栏
+//	<!-- /columns -->    结束分栏，恢复单栏
+func (r *DocxRenderer) renderDirective(tokens []byte) bool {
+	name, arg, ok := parseDirective(tokens)
+	if !ok {
+		return false
+	}
+
+	switch name {
+	case "columns":
+		columns := r.PageSetup.Columns
+		if "" != arg {
+			n, err := strconv.Atoi(arg)
+			if nil != err || 1 > n {
+				logger.Warnf("invalid columns directive [%s]", tokens)
+				return true
+			}
+			columns = n
+		}
+		r.closeSection(wml.ST_SectionMarkContinuous, columns)
+	case "/columns":
+		r.closeSection(wml.ST_SectionMarkContinuous, 1)
+	default:
+		return false
+	}
+	return true
+}
+
+// hasColumnsDirective 判断文档中是否使用了分栏指令。
+func (r *DocxRenderer) hasColumnsDirective() (ret bool) {
+	ast.Walk(r.Tree.Root, func(n *ast.Node, entering bool) ast.WalkStatus {
+		if !entering || ast.NodeHTMLBlock != n.Type {
+			return ast.WalkContinue
+		}
+		if name, _, ok := parseDirective(n.Tokens); ok && "columns" == name {
+			ret = true
+			return ast.WalkStop
+		}
+		return ast.WalkContinue
+	})
+	return
+}
+
+// closeSection 结束当前分节，后续内容以 t 的方式开始一个新的分节，新分节分为 columns 栏。
+func (r *DocxRenderer) closeSection(t wml.ST_SectionMark, columns int) document.Section {
+	para := r.doc.AddParagraph()
+	section := para.Properties().AddSection(r.sectionType)
+	r.setSection(section)
+	r.setPageNumber(section)
+	if r.sectionCover {
+		r.setCoverHeaderFooter(section)
+	} else {
+		r.setHeaderFooter(section)
+	}
+	r.sectionCover = false
+	r.frontMatter = false
+	r.sectionType = t
+	r.columns = columns
+	return section
+}
+
+// renderBodySection 设置文档最后一个分节的属性。
+func (r *DocxRenderer) renderBodySection() {
+	section := r.doc.BodySection()
+	if wml.ST_SectionMarkUnset != r.sectionType {
+		section.X().Type = wml.NewCT_SectType()
+		section.X().Type.ValAttr = r.sectionType
+	}
+	r.setSection(section)
+	r.setPageNumber(section)
+	r.setHeaderFooter(section)
+}
+
+// setPageNumber 设置分节 section 的页码格式：前置部分（封面、目录）使用小写罗马数字，正文从 1 开始编号。
+func (r *DocxRenderer) setPageNumber(section document.Section) {
+	pgNumType := wml.NewCT_PageNumber()
+	if r.frontMatter {
+		pgNumType.FmtAttr = wml.ST_NumberFormatLowerRoman
+		if !r.hasFrontMatter {
+			pgNumType.StartAttr = unioffice.Int64(1)
+		}
+		r.hasFrontMatter = true
+		r.restartPageNumber = true
+	} else if r.hasFrontMatter {
+		pgNumType.FmtAttr = wml.ST_NumberFormatDecimal
+		if r.restartPageNumber {
+			pgNumType.StartAttr = unioffice.Int64(1)
+			r.restartPageNumber = false
+		}
+	} else {
+		return
+	}
+	section.X().PgNumType = pgNumType
+}
+
+// setSection 将页面设置和当前分栏应用到分节 section 上。
+func (r *DocxRenderer) setSection(section document.Section) {
+	setup := r.PageSetup
+	width, height, err := setup.PageSize()
+	if nil != err {
+		logger.Warnf("%s, use A4 instead", err)
+		width, height = pageSizes["a4"][0], pageSizes["a4"][1]
+		if setup.Landscape {
+			width, height = height, width
+		}
+	}
+	pgSz := wml.NewCT_PageSz()
+	pgSz.WAttr = twipsMeasure(width)
+	pgSz.HAttr = twipsMeasure(height)
+	pgSz.OrientAttr = wml.ST_PageOrientationPortrait
+	if setup.Landscape {
+		pgSz.OrientAttr = wml.ST_PageOrientationLandscape
+	}
+	section.X().PgSz = pgSz
+	section.SetPageMargins(mm(setup.MarginTop), mm(setup.MarginRight), mm(setup.MarginBottom), mm(setup.MarginLeft),
+		mm(setup.HeaderDistance), mm(setup.FooterDistance), 0)
+
+	if 2 > r.columns {
+		section.X().Cols = nil
+		return
+	}
+
+	cols := wml.NewCT_Columns()
+	cols.NumAttr = unioffice.Int64(int64(r.columns))
+	cols.SpaceAttr = twipsMeasure(setup.ColumnSpace)
+	section.X().Cols = cols
+}
+
+// textWidth 返回版心宽度（毫米）。
+func (r *DocxRenderer) textWidth() float64 {
+	width, _, err := r.PageSetup.PageSize()
+	if nil != err {
+		width = pageSizes["a4"][0]
+	}
+	return width - r.PageSetup.MarginLeft - r.PageSetup.MarginRight
+}
+
+// textHeight 返回版心高度（毫米）。
+func (r *DocxRenderer) textHeight() float64 {
+	_, height, err := r.PageSetup.PageSize()
+	if nil != err {
+		height = pageSizes["a4"][1]
+	}
+	return height - r.PageSetup.MarginTop - r.PageSetup.MarginBottom
+}
+
+// columnWidth 返回当前分节中每栏的宽度（毫米）。
+func (r *DocxRenderer) columnWidth() float64 {
+	width := r.textWidth()
+	if 2 > r.columns {
+		return width
+	}
+	return (width - r.PageSetup.ColumnSpace*float64(r.columns-1)) / float64(r.columns)
+}
+
+// mm 将毫米转换为 measurement.Distance。
+func mm(millimeter float64) measurement.Distance {
+	return measurement.Distance(millimeter) * measurement.Millimeter
+}
+
+// twipsMeasure 将毫米转换为 DOCX 中以缇为单位的长度，负数按照 0 处理。
+func twipsMeasure(millimeter float64) *sharedTypes.ST_TwipsMeasure {
+	twips := uint64(math.Max(0, math.Round(float64(mm(millimeter)/measurement.Twips))))
+	return &sharedTypes.ST_TwipsMeasure{ST_UnsignedDecimalNumber: unioffice.Uint64(twips)}
+}
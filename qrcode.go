@@ -0,0 +1,110 @@
+// Lute DOCX - 一款将 Markdown 文本转换为 Word 文档 (.docx) 的小工具
+// Copyright (c) 2020-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"strings"
+
+	"github.com/skip2/go-qrcode"
+	"github.com/unidoc/unioffice/document"
+	"github.com/unidoc/unioffice/schema/soo/wml"
+)
+
+const (
+	coverQRCodeSize  = 30  // 封面二维码默认边长（毫米）
+	footerQRCodeSize = 15  // 页脚二维码默认边长（毫米）
+	qrCodePixels     = 512 // 二维码图片边长（像素）
+)
+
+// qrCodeOn 判断是否在位置 position（cover 或者 footer）生成原文链接二维码。
+func (cover *DocxCover) qrCodeOn(position string) bool {
+	qrCode := strings.ToLower(cover.QRCode)
+	return position == qrCode || "both" == qrCode
+}
+
+// qrCodeImage 生成原文链接的二维码 PNG 图片。
+func (r *DocxRenderer) qrCodeImage() (data []byte, ok bool) {
+	data, err := qrcode.Encode(r.Cover.Link, qrcode.Medium, qrCodePixels)
+	if nil != err {
+		logger.Warnf("generate QR code for [%s] failed: %s", r.Cover.Link, err)
+		return nil, false
+	}
+	return data, true
+}
+
+// renderCoverQRCode 在封面上渲染原文链接二维码。
+func (r *DocxRenderer) renderCoverQRCode(element *DocxCoverElement) {
+	data, ok := r.qrCodeImage()
+	if !ok {
+		return
+	}
+	imgRef, _, err := r.addImage(data)
+	if nil != err {
+		logger.Warnf("add QR code failed: %s", err)
+		return
+	}
+
+	qrElement := *element
+	if "" != r.Cover.QRCodeAlign {
+		qrElement.Align = r.Cover.QRCodeAlign
+	} else if "" == qrElement.Align {
+		qrElement.Align = "center"
+	}
+	size := float64(coverQRCodeSize)
+	if 0 < r.Cover.QRCodeSize {
+		size = r.Cover.QRCodeSize
+	} else if 0 < element.Size {
+		size = element.Size
+	}
+	para := r.addCoverParagraph(&qrElement)
+	inline, _ := para.AddRun().AddDrawingInline(imgRef)
+	inline.SetSize(mm(size), mm(size))
+	setImageDescription(inline, r.Cover.Link, "")
+}
+
+// renderFooterQRCode 在原文链接页脚 footer 的段落 para 中渲染原文链接二维码。
+func (r *DocxRenderer) renderFooterQRCode(footer document.Footer, para document.Paragraph) {
+	data, ok := r.qrCodeImage()
+	if !ok {
+		return
+	}
+	// 页脚中的图片需要通过页脚自己的关系引用，unioffice 不支持指向正文中已有的图片文件，所以这里不能使用 addImage 去重
+	img, err := imageFromBytes(data)
+	if nil != err {
+		logger.Warnf("load QR code failed: %s", err)
+		return
+	}
+	imgRef, err := footer.AddImage(img)
+	if nil != err {
+		logger.Warnf("add QR code failed: %s", err)
+		return
+	}
+
+	switch strings.ToLower(r.Cover.QRCodeAlign) {
+	case "left":
+		para.Properties().SetAlignment(wml.ST_JcLeft)
+	case "center":
+		para.Properties().SetAlignment(wml.ST_JcCenter)
+	}
+	size := float64(footerQRCodeSize)
+	if 0 < r.Cover.QRCodeSize {
+		size = r.Cover.QRCodeSize
+	}
+	inline, _ := para.AddRun().AddDrawingInline(imgRef)
+	inline.SetSize(mm(size), mm(size))
+	setImageDescription(inline, r.Cover.Link, "")
+}
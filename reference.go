@@ -0,0 +1,95 @@
+// Lute DOCX - 一款将 Markdown 文本转换为 Word 文档 (.docx) 的小工具
+// Copyright (c) 2020-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"github.com/88250/lute/parse"
+	"github.com/88250/lute/render"
+	"github.com/unidoc/unioffice/document"
+	"github.com/unidoc/unioffice/measurement"
+	"github.com/unidoc/unioffice/schema/soo/ofc/sharedTypes"
+	"github.com/unidoc/unioffice/schema/soo/wml"
+)
+
+// NewDocxRendererWithReferenceDoc 创建一个基于参考文档 referenceDocPath 的 DOCX 渲染器。
+//
+// 生成的文档沿用参考文档的样式、编号、主题、字体、页面设置和页眉页脚，但不包含参考文档的正文内容。
+// 标题、代码、代码块、引述和超链接按照样式名称（比如 heading 1、Code、Code Block、Quote、Hyperlink）
+// 使用参考文档中的样式，参考文档中没有的样式使用内置样式。
+func NewDocxRendererWithReferenceDoc(tree *parse.Tree, options *render.Options, referenceDocPath string) (*DocxRenderer, error) {
+	doc, err := document.Open(referenceDocPath)
+	if nil != err {
+		return nil, err
+	}
+
+	sectPr := doc.X().Body.SectPr
+	doc.X().Body = wml.NewCT_Body()
+	ret := newDocxRenderer(tree, options, doc, true)
+	if nil != sectPr {
+		ret.PageSetup = pageSetupFromSection(sectPr)
+		// 页眉页脚引用由 setHeaderFooter 统一设置到每个分节上
+		ret.referenceHdrFtrRefs = sectPr.EG_HdrFtrReferences
+		sectPr.EG_HdrFtrReferences = nil
+		doc.X().Body.SectPr = sectPr
+	}
+	return ret, nil
+}
+
+// pageSetupFromSection 返回分节属性 sectPr 中的页面设置，sectPr 中没有的设置使用默认值。
+func pageSetupFromSection(sectPr *wml.CT_SectPr) *DocxPageSetup {
+	ret := NewDocxPageSetup()
+	if pgSz := sectPr.PgSz; nil != pgSz && nil != pgSz.WAttr && nil != pgSz.HAttr {
+		width, height := twipsToMM(pgSz.WAttr), twipsToMM(pgSz.HAttr)
+		if 0 < width && 0 < height {
+			ret.Size = "Custom"
+			ret.Landscape = wml.ST_PageOrientationLandscape == pgSz.OrientAttr
+			if ret.Landscape {
+				width, height = height, width
+			}
+			ret.Width, ret.Height = width, height
+		}
+	}
+	if pgMar := sectPr.PgMar; nil != pgMar {
+		if nil != pgMar.TopAttr.Int64 {
+			ret.MarginTop = float64(*pgMar.TopAttr.Int64) * float64(measurement.Twips/measurement.Millimeter)
+		}
+		if nil != pgMar.BottomAttr.Int64 {
+			ret.MarginBottom = float64(*pgMar.BottomAttr.Int64) * float64(measurement.Twips/measurement.Millimeter)
+		}
+		ret.MarginRight = twipsToMM(&pgMar.RightAttr)
+		ret.MarginLeft = twipsToMM(&pgMar.LeftAttr)
+		ret.HeaderDistance = twipsToMM(&pgMar.HeaderAttr)
+		ret.FooterDistance = twipsToMM(&pgMar.FooterAttr)
+	}
+	if cols := sectPr.Cols; nil != cols {
+		if nil != cols.NumAttr && 0 < *cols.NumAttr {
+			ret.Columns = int(*cols.NumAttr)
+		}
+		if nil != cols.SpaceAttr {
+			ret.ColumnSpace = twipsToMM(cols.SpaceAttr)
+		}
+	}
+	return ret
+}
+
+// twipsToMM 将 DOCX 中以缇为单位的长度转换为毫米，不支持带单位的长度，这时返回 0。
+func twipsToMM(twips *sharedTypes.ST_TwipsMeasure) float64 {
+	if nil == twips.ST_UnsignedDecimalNumber {
+		return 0
+	}
+	return float64(*twips.ST_UnsignedDecimalNumber) * float64(measurement.Twips/measurement.Millimeter)
+}
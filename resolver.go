@@ -0,0 +1,503 @@
+// Lute DOCX - 一款将 Markdown 文本转换为 Word 文档 (.docx) 的小工具
+// Copyright (c) 2020-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// ErrImageNotResolved 描述了图片解析器无法处理某个图片地址的错误，链式解析器遇到该错误时会尝试下一个解析器。
+var ErrImageNotResolved = errors.New("image not resolved")
+
+// ImageResolver 描述了图片解析器，用于根据图片地址获取图片内容，可以用来接入内部资源库、添加认证信息或者在测试中避免访问网络。
+type ImageResolver interface {
+	// Resolve 返回图片地址 src 对应的图片内容和 MIME 类型，无法处理该地址时返回 ErrImageNotResolved。
+	Resolve(src string) (data []byte, mimeType string, err error)
+}
+
+// ImagePolicy 描述了图片解析器的访问策略。图片解析器实现该接口时，渲染器在使用图片缓存前也会检查图片地址，
+// 并使用 CacheKey 作为图片缓存的键，这样缓存不会绕过访问限制，也不会将携带凭据下载的图片提供给其他请求。
+type ImagePolicy interface {
+	// Check 检查是否允许获取图片地址 src，不允许时返回错误。lookup 为 false 时（比如离线模式）不能访问网络，不解析域名。
+	Check(src string, lookup bool) error
+	// CacheKey 返回图片地址 src 在图片缓存中的键，会影响图片内容的请求凭据等信息也需要包含在其中。
+	CacheKey(src string) string
+}
+
+// ChainImageResolver 描述了链式图片解析器，按顺序使用其中的解析器，返回第一个成功解析的结果。
+type ChainImageResolver []ImageResolver
+
+// Resolve 依次使用解析器解析图片地址 src，所有解析器都无法处理时返回 ErrImageNotResolved。
+func (chain ChainImageResolver) Resolve(src string) (data []byte, mimeType string, err error) {
+	err = ErrImageNotResolved
+	for _, resolver := range chain {
+		var e error
+		if data, mimeType, e = resolver.Resolve(src); nil == e {
+			return data, mimeType, nil
+		}
+		if ErrImageNotResolved != e {
+			err = e
+		}
+	}
+	return nil, "", err
+}
+
+// Check 使用链中实现了 ImagePolicy 的解析器依次检查图片地址 src。
+func (chain ChainImageResolver) Check(src string, lookup bool) error {
+	for _, resolver := range chain {
+		if policy, ok := resolver.(ImagePolicy); ok {
+			if err := policy.Check(src, lookup); nil != err {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// CacheKey 返回链中第一个实现了 ImagePolicy 的解析器给出的缓存键，没有这样的解析器时返回 src。
+func (chain ChainImageResolver) CacheKey(src string) string {
+	for _, resolver := range chain {
+		if policy, ok := resolver.(ImagePolicy); ok {
+			return policy.CacheKey(src)
+		}
+	}
+	return src
+}
+
+// HTTPImageResolver 描述了 HTTP 图片解析器，用于下载 HTTP 和 HTTPS 图片。
+//
+// 转换不受信任的 Markdown 时建议开启 BlockPrivateIPs 并设置 MaxSize 和 MaxCount，避免通过图片地址访问内网服务（SSRF）或者耗尽资源。
+type HTTPImageResolver struct {
+	Client          *http.Client   // HTTP 客户端，为空时按照 Proxy、Timeout 和 BlockPrivateIPs 创建
+	UserAgent       string         // 请求使用的 User-Agent，为空时使用 Lute-DOCX
+	Header          http.Header    // 额外的请求头，比如 Authorization
+	Cookies         []*http.Cookie // 请求附带的 Cookie
+	Proxy           string         // 代理地址，比如 http://127.0.0.1:8080，为空时使用环境变量 HTTP_PROXY、HTTPS_PROXY 和 NO_PROXY（开启 BlockPrivateIPs 时不使用环境变量）
+	Timeout         time.Duration  // 单次请求超时时间，为 0 时使用 5 秒
+	Retries         int            // 请求失败（网络错误、429 或者 5xx）后的重试次数
+	RetryBackoff    time.Duration  // 首次重试前的等待时间，之后每次加倍，为 0 时使用 500 毫秒
+	MaxSize         int64          // 单个图片的最大字节数，为 0 时不限制
+	MaxCount        int            // 最多下载的图片数，为 0 时不限制
+	AllowHosts      []string       // 允许访问的主机，为空时允许所有主机，支持 *.example.com 形式的通配
+	DenyHosts       []string       // 禁止访问的主机，优先于 AllowHosts，支持 *.example.com 形式的通配
+	BlockPrivateIPs bool           // 是否禁止访问回环、内网、链路本地等非公网地址，比如 http://169.254.169.254/
+
+	clientOnce sync.Once    // 用于创建默认 HTTP 客户端
+	client     *http.Client // 默认 HTTP 客户端
+	count      int32        // 已经下载的图片数
+}
+
+// Resolve 下载图片地址 src，src 不是 HTTP 或者 HTTPS 地址时返回 ErrImageNotResolved。
+func (resolver *HTTPImageResolver) Resolve(src string) (data []byte, mimeType string, err error) {
+	u, err := url.Parse(src)
+	if nil != err || ("http" != u.Scheme && "https" != u.Scheme) {
+		return nil, "", ErrImageNotResolved
+	}
+	if err = resolver.checkURL(u, true); nil != err {
+		return nil, "", err
+	}
+	if 0 < resolver.MaxCount && int32(resolver.MaxCount) < atomic.AddInt32(&resolver.count, 1) {
+		return nil, "", fmt.Errorf("exceeds max image count [%d]", resolver.MaxCount)
+	}
+
+	backoff := resolver.RetryBackoff
+	if 0 >= backoff {
+		backoff = 500 * time.Millisecond
+	}
+	for attempt := 0; ; attempt++ {
+		var contentType string
+		var retryable bool
+		data, contentType, retryable, err = resolver.get(u)
+		if nil == err {
+			return data, imageMimeType(src, contentType, data), nil
+		}
+		if !retryable || attempt >= resolver.Retries {
+			return nil, "", err
+		}
+		time.Sleep(backoff << uint(attempt))
+	}
+}
+
+// Check 按照 AllowHosts、DenyHosts 和 BlockPrivateIPs 检查是否允许下载图片地址 src，src 不是 HTTP 或者 HTTPS 地址时不检查。
+// lookup 为 false 时只检查 IP 地址形式的主机，不解析域名。
+func (resolver *HTTPImageResolver) Check(src string, lookup bool) error {
+	u, err := url.Parse(src)
+	if nil != err || ("http" != u.Scheme && "https" != u.Scheme) {
+		return nil
+	}
+	return resolver.checkURL(u, lookup)
+}
+
+// CacheKey 返回图片地址 src 在图片缓存中的键。设置了 Header 或者 Cookies 时键中包含这些请求凭据，
+// 这样携带不同凭据下载的同一个地址的图片不会共用缓存。
+func (resolver *HTTPImageResolver) CacheKey(src string) string {
+	if 1 > len(resolver.Header) && 1 > len(resolver.Cookies) {
+		return src
+	}
+
+	var lines []string
+	for name, values := range resolver.Header {
+		for _, value := range values {
+			lines = append(lines, http.CanonicalHeaderKey(name)+": "+value)
+		}
+	}
+	sort.Strings(lines)
+	buf := strings.Builder{}
+	buf.WriteString(src)
+	for _, line := range lines {
+		buf.WriteString("\n" + line)
+	}
+	for _, cookie := range resolver.Cookies {
+		buf.WriteString("\nCookie: " + cookie.Name + "=" + cookie.Value)
+	}
+	return buf.String()
+}
+
+// get 发送一次请求下载图片 u，retryable 表示失败后是否可以重试。
+func (resolver *HTTPImageResolver) get(u *url.URL) (data []byte, contentType string, retryable bool, err error) {
+	userAgent := resolver.UserAgent
+	if "" == userAgent {
+		userAgent = "Lute-DOCX; +https://github.com/88250/lute-docx"
+	}
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if nil != err {
+		return nil, "", false, err
+	}
+	for name, values := range resolver.Header {
+		for _, value := range values {
+			req.Header.Add(name, value)
+		}
+	}
+	req.Header.Set("User-Agent", userAgent)
+	for _, cookie := range resolver.Cookies {
+		req.AddCookie(cookie)
+	}
+
+	resp, err := resolver.httpClient().Do(req)
+	if nil != err {
+		var blocked *blockedAddrError
+		var dnsErr *net.DNSError
+		retryable = !errors.As(err, &blocked) && !(errors.As(err, &dnsErr) && !dnsErr.Temporary())
+		return nil, "", retryable, err
+	}
+	defer resp.Body.Close()
+	if 200 != resp.StatusCode {
+		retryable = http.StatusTooManyRequests == resp.StatusCode || 500 <= resp.StatusCode
+		return nil, "", retryable, fmt.Errorf("status code is [%d]", resp.StatusCode)
+	}
+
+	body := io.Reader(resp.Body)
+	if 0 < resolver.MaxSize {
+		if resp.ContentLength > resolver.MaxSize {
+			return nil, "", false, fmt.Errorf("size [%d] exceeds max size [%d]", resp.ContentLength, resolver.MaxSize)
+		}
+		body = io.LimitReader(resp.Body, resolver.MaxSize+1)
+	}
+	if data, err = ioutil.ReadAll(body); nil != err {
+		return nil, "", true, err
+	}
+	if 0 < resolver.MaxSize && int64(len(data)) > resolver.MaxSize {
+		return nil, "", false, fmt.Errorf("size exceeds max size [%d]", resolver.MaxSize)
+	}
+	return data, resp.Header.Get("Content-Type"), false, nil
+}
+
+// httpClient 返回下载使用的 HTTP 客户端，没有设置 Client 时创建一个默认客户端，重定向时同样检查主机和地址。
+func (resolver *HTTPImageResolver) httpClient() *http.Client {
+	if nil != resolver.Client {
+		return resolver.Client
+	}
+
+	resolver.clientOnce.Do(func() {
+		timeout := resolver.Timeout
+		if 0 >= timeout {
+			timeout = 5 * time.Second
+		}
+		dialer := &net.Dialer{Timeout: timeout}
+		proxy := http.ProxyFromEnvironment
+		if "" != resolver.Proxy {
+			if proxyURL, err := url.Parse(resolver.Proxy); nil == err {
+				proxy = http.ProxyURL(proxyURL)
+			} else {
+				logger.Warnf("invalid proxy [%s]: %s", resolver.Proxy, err)
+			}
+		}
+		if resolver.BlockPrivateIPs && "" == resolver.Proxy {
+			// 直接连接并在建立连接时检查实际连接的地址，避免通过 DNS 解析到内网地址绕过检查
+			proxy = nil
+			dialer.Control = func(network, address string, c syscall.RawConn) error {
+				host, _, err := net.SplitHostPort(address)
+				if nil != err {
+					return err
+				}
+				if ip := net.ParseIP(host); nil != ip && isPrivateIP(ip) {
+					return &blockedAddrError{host}
+				}
+				return nil
+			}
+		}
+		resolver.client = &http.Client{
+			Timeout: timeout,
+			Transport: &http.Transport{
+				Proxy:               proxy,
+				DialContext:         dialer.DialContext,
+				TLSHandshakeTimeout: timeout,
+			},
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				if 10 <= len(via) {
+					return errors.New("stopped after 10 redirects")
+				}
+				return resolver.checkURL(req.URL, true)
+			},
+		}
+	})
+	return resolver.client
+}
+
+// checkURL 按照 AllowHosts、DenyHosts 和 BlockPrivateIPs 检查是否允许访问 u，lookup 为 false 时不解析域名。
+func (resolver *HTTPImageResolver) checkURL(u *url.URL, lookup bool) error {
+	host := strings.ToLower(strings.TrimSuffix(u.Hostname(), "."))
+	if matchHost(host, resolver.DenyHosts) {
+		return &blockedAddrError{host}
+	}
+	if 0 < len(resolver.AllowHosts) && !matchHost(host, resolver.AllowHosts) {
+		return &blockedAddrError{host}
+	}
+	if !resolver.BlockPrivateIPs {
+		return nil
+	}
+
+	ips := []net.IP{net.ParseIP(host)}
+	if nil == ips[0] {
+		if !lookup {
+			return nil
+		}
+		addrs, err := net.LookupIP(host)
+		if nil != err {
+			return err
+		}
+		ips = addrs
+	}
+	for _, ip := range ips {
+		if isPrivateIP(ip) {
+			return &blockedAddrError{host}
+		}
+	}
+	return nil
+}
+
+// blockedAddrError 描述了禁止访问某个主机或者地址的错误。
+type blockedAddrError struct {
+	addr string // 被禁止访问的主机或者地址
+}
+
+func (err *blockedAddrError) Error() string {
+	return fmt.Sprintf("access to [%s] is not allowed", err.addr)
+}
+
+// matchHost 判断主机 host 是否匹配 patterns 中的某一项，*.example.com 匹配 example.com 的所有子域名。
+func matchHost(host string, patterns []string) bool {
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(strings.TrimSpace(pattern))
+		if "" == pattern {
+			continue
+		}
+		if strings.HasPrefix(pattern, "*.") {
+			if strings.HasSuffix(host, pattern[1:]) {
+				return true
+			}
+			continue
+		}
+		if host == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+// privateNetworks 描述了非公网地址段，包括回环、内网、链路本地、运营商级 NAT、唯一本地、本地 NAT64 和组播等地址。
+var privateNetworks = func() (ret []*net.IPNet) {
+	for _, cidr := range []string{
+		"0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "127.0.0.0/8", "169.254.0.0/16", "172.16.0.0/12",
+		"192.0.0.0/24", "192.168.0.0/16", "198.18.0.0/15", "224.0.0.0/4", "240.0.0.0/4",
+		"::/128", "::1/128", "64:ff9b:1::/48", "fc00::/7", "fe80::/10", "ff00::/8",
+	} {
+		_, network, _ := net.ParseCIDR(cidr)
+		ret = append(ret, network)
+	}
+	return
+}()
+
+// embeddedIPv4Network 描述了内嵌 IPv4 地址的 IPv6 地址段。
+type embeddedIPv4Network struct {
+	network *net.IPNet // IPv6 地址段
+	offset  int        // IPv4 地址在 IPv6 地址中的字节偏移
+}
+
+// embeddedIPv4Networks 描述了内嵌 IPv4 地址的 IPv6 地址段，包括 NAT64 和 6to4 地址。
+var embeddedIPv4Networks = []embeddedIPv4Network{
+	{parseCIDR("64:ff9b::/96"), 12},
+	{parseCIDR("2002::/16"), 2},
+}
+
+// parseCIDR 解析 CIDR 形式的地址段 cidr，cidr 必须合法。
+func parseCIDR(cidr string) *net.IPNet {
+	_, network, err := net.ParseCIDR(cidr)
+	if nil != err {
+		panic(err)
+	}
+	return network
+}
+
+// isPrivateIP 判断 ip 是否是非公网地址，NAT64 和 6to4 地址按照其中内嵌的 IPv4 地址判断。
+func isPrivateIP(ip net.IP) bool {
+	if ip4 := ip.To4(); nil != ip4 {
+		ip = ip4
+	} else if ip16 := ip.To16(); nil != ip16 {
+		for _, embedded := range embeddedIPv4Networks {
+			if embedded.network.Contains(ip16) {
+				ip = ip16[embedded.offset : embedded.offset+net.IPv4len]
+				break
+			}
+		}
+	}
+	for _, network := range privateNetworks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// FileImageResolver 描述了本地文件图片解析器。
+//
+// 转换不受信任的 Markdown 时需要开启 Restrict，避免通过 file:// 地址、绝对路径或者 ../ 读取任意本地图片。
+type FileImageResolver struct {
+	BaseDir     string   // 解析相对路径的基础目录，为空时使用当前工作目录
+	SearchPaths []string // 搜索路径，在 BaseDir 中找不到图片时依次查找，相对路径基于 BaseDir
+	Restrict    bool     // 是否只允许读取 BaseDir 和 SearchPaths 中的图片，开启后不支持 file:// 地址和绝对路径
+}
+
+// Resolve 读取本地图片文件 src，src 是 URL 或者文件不存在时返回 ErrImageNotResolved。
+func (resolver *FileImageResolver) Resolve(src string) (data []byte, mimeType string, err error) {
+	if u, e := url.Parse(src); nil == e && "" != u.Scheme && !isWindowsVolume(u.Scheme) {
+		if "file" != u.Scheme || resolver.Restrict {
+			return nil, "", ErrImageNotResolved
+		}
+		src = u.Path
+	}
+
+	localPath, exists := resolver.ResolvePath(src)
+	if !exists {
+		return nil, "", ErrImageNotResolved
+	}
+	if data, err = ioutil.ReadFile(localPath); nil != err {
+		return nil, "", err
+	}
+	return data, imageMimeType(localPath, "", data), nil
+}
+
+// ResolvePath 解析本地文件路径 src，返回文件路径以及文件是否存在。
+//
+// 相对路径依次在 BaseDir 和 SearchPaths 中查找。src 中的 URL 转义（比如 %20）也会尝试解码后查找。
+// 开启 Restrict 时不查找绝对路径，也不查找通过 ../ 跳出所在目录的路径。找不到文件时返回基于 BaseDir 的路径。
+func (resolver *FileImageResolver) ResolvePath(src string) (string, bool) {
+	candidates := []string{src}
+	if unescaped, err := url.PathUnescape(src); nil == err && unescaped != src {
+		candidates = append(candidates, unescaped)
+	}
+
+	var dirs []string
+	dirs = append(dirs, resolver.BaseDir)
+	for _, searchPath := range resolver.SearchPaths {
+		if !filepath.IsAbs(searchPath) {
+			searchPath = filepath.Join(resolver.BaseDir, searchPath)
+		}
+		dirs = append(dirs, searchPath)
+	}
+
+	for _, candidate := range candidates {
+		candidate = filepath.FromSlash(candidate)
+		if filepath.IsAbs(candidate) {
+			if !resolver.Restrict && fileExists(candidate) {
+				return candidate, true
+			}
+			continue
+		}
+		for _, dir := range dirs {
+			p := filepath.Join(dir, candidate)
+			if resolver.Restrict && !isSubPath(dir, p) {
+				continue
+			}
+			if fileExists(p) {
+				return p, true
+			}
+		}
+	}
+	if filepath.IsAbs(src) {
+		return src, false
+	}
+	return filepath.Join(resolver.BaseDir, filepath.FromSlash(src)), false
+}
+
+// isSubPath 判断清理后的路径 p 是否在目录 dir 中。
+func isSubPath(dir, p string) bool {
+	rel, err := filepath.Rel(filepath.Clean(dir), filepath.Clean(p))
+	return nil == err && ".." != rel && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) && !filepath.IsAbs(rel)
+}
+
+// MapImageResolver 描述了内存图片解析器，图片地址到图片内容的映射，可以用于测试或者图片已经在内存中的场景。
+type MapImageResolver map[string][]byte
+
+// Resolve 返回映射中图片地址 src 对应的图片内容，不存在时返回 ErrImageNotResolved。
+func (images MapImageResolver) Resolve(src string) (data []byte, mimeType string, err error) {
+	data, ok := images[src]
+	if !ok {
+		return nil, "", ErrImageNotResolved
+	}
+	return data, imageMimeType(src, "", data), nil
+}
+
+// imageMimeType 返回图片的 MIME 类型，依次取自响应头中的内容类型 contentType、图片内容 data 和地址 src 的扩展名。
+func imageMimeType(src, contentType string, data []byte) string {
+	if mediaType, _, err := mime.ParseMediaType(contentType); nil == err && strings.HasPrefix(mediaType, "image/") {
+		return mediaType
+	}
+	if detected := http.DetectContentType(data); strings.HasPrefix(detected, "image/") {
+		return detected
+	}
+	if ext := filepath.Ext(strings.SplitN(src, "?", 2)[0]); "" != ext {
+		if byExt := mime.TypeByExtension(ext); "" != byExt {
+			return byExt
+		}
+	}
+	return "application/octet-stream"
+}
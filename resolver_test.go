@@ -0,0 +1,146 @@
+// Lute DOCX - 一款将 Markdown 文本转换为 Word 文档 (.docx) 的小工具
+// Copyright (c) 2020-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"net"
+	"net/url"
+	"path/filepath"
+	"testing"
+)
+
+func TestIsPrivateIP(t *testing.T) {
+	cases := []struct {
+		ip      string
+		private bool
+	}{
+		{"127.0.0.1", true},
+		{"10.1.2.3", true},
+		{"172.16.0.1", true},
+		{"172.32.0.1", false},
+		{"192.168.1.1", true},
+		{"169.254.169.254", true},
+		{"100.64.0.1", true},
+		{"0.0.0.0", true},
+		{"224.0.0.1", true},
+		{"8.8.8.8", false},
+		{"::1", true},
+		{"::", true},
+		{"::ffff:127.0.0.1", true},
+		{"::ffff:8.8.8.8", false},
+		{"fd00::1", true},
+		{"fe80::1", true},
+		{"ff02::1", true},
+		{"64:ff9b::7f00:1", true},
+		{"64:ff9b::a9fe:a9fe", true},
+		{"64:ff9b::808:808", false},
+		{"64:ff9b:1::1", true},
+		{"2002:7f00:1::", true},
+		{"2002:808:808::", false},
+		{"2001:4860:4860::8888", false},
+	}
+	for _, c := range cases {
+		if private := isPrivateIP(net.ParseIP(c.ip)); c.private != private {
+			t.Errorf("isPrivateIP(%s) = %v, want %v", c.ip, private, c.private)
+		}
+	}
+}
+
+func TestMatchHost(t *testing.T) {
+	patterns := []string{" Example.com ", "*.example.org", ""}
+	cases := []struct {
+		host  string
+		match bool
+	}{
+		{"example.com", true},
+		{"www.example.com", false},
+		{"a.example.org", true},
+		{"a.b.example.org", true},
+		{"example.org", false},
+		{"evilexample.org", false},
+		{"", false},
+	}
+	for _, c := range cases {
+		if match := matchHost(c.host, patterns); c.match != match {
+			t.Errorf("matchHost(%q) = %v, want %v", c.host, match, c.match)
+		}
+	}
+}
+
+func TestIsSubPath(t *testing.T) {
+	dir := filepath.FromSlash("/srv/docs")
+	cases := []struct {
+		p   string
+		sub bool
+	}{
+		{"/srv/docs", true},
+		{"/srv/docs/a.png", true},
+		{"/srv/docs/img/../a.png", true},
+		{"/srv/docs/../docs2/a.png", false},
+		{"/srv/docs2/a.png", false},
+		{"/srv/docs/../../etc/passwd", false},
+		{"/etc/passwd", false},
+		{"/srv/docs/..a.png", true},
+	}
+	for _, c := range cases {
+		if sub := isSubPath(dir, filepath.FromSlash(c.p)); c.sub != sub {
+			t.Errorf("isSubPath(%s) = %v, want %v", c.p, sub, c.sub)
+		}
+	}
+}
+
+func TestCheckURL(t *testing.T) {
+	resolver := &HTTPImageResolver{
+		AllowHosts:      []string{"*.example.com", "127.0.0.1", "64:ff9b::7f00:1"},
+		DenyHosts:       []string{"deny.example.com"},
+		BlockPrivateIPs: true,
+	}
+	cases := []struct {
+		src     string
+		allowed bool
+	}{
+		{"https://img.example.com/a.png", true},
+		{"https://deny.example.com/a.png", false},
+		{"https://IMG.Example.com./a.png", true},
+		{"https://example.org/a.png", false},
+		{"http://127.0.0.1/a.png", false},
+		{"http://[64:ff9b::7f00:1]/a.png", false},
+	}
+	for _, c := range cases {
+		u, _ := url.Parse(c.src)
+		// 不解析域名，避免测试访问网络
+		if err := resolver.checkURL(u, false); c.allowed != (nil == err) {
+			t.Errorf("checkURL(%s) = %v, want allowed %v", c.src, err, c.allowed)
+		}
+	}
+
+	resolver = &HTTPImageResolver{BlockPrivateIPs: true}
+	for _, src := range []string{"http://169.254.169.254/", "http://[::1]:8080/", "http://10.0.0.1/", "http://[::ffff:192.168.0.1]/"} {
+		u, _ := url.Parse(src)
+		if nil == resolver.checkURL(u, false) {
+			t.Errorf("checkURL(%s) should be blocked", src)
+		}
+	}
+	u, _ := url.Parse("http://93.184.216.34/")
+	if err := resolver.checkURL(u, false); nil != err {
+		t.Errorf("checkURL(%s) = %v, want allowed", u, err)
+	}
+	u, _ = url.Parse("http://offline.invalid/")
+	if err := resolver.checkURL(u, false); nil != err {
+		t.Errorf("checkURL(%s) without lookup = %v, want allowed", u, err)
+	}
+}
@@ -0,0 +1,94 @@
+// Lute DOCX - 一款将 Markdown 文本转换为 Word 文档 (.docx) 的小工具
+// Copyright (c) 2020-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// resolveLocalPath 按照 BaseDir 和 SearchPaths 解析本地文件路径 src，返回文件路径以及文件是否存在。
+func (r *DocxRenderer) resolveLocalPath(src string) (string, bool) {
+	resolver := &FileImageResolver{BaseDir: r.BaseDir, SearchPaths: r.SearchPaths, Restrict: r.RestrictLocal}
+	return resolver.ResolvePath(src)
+}
+
+// localLinkTarget 返回链接地址 dest 对应的超链接目标。dest 是本地文件的相对路径时，解析为文件的 file:// 地址，否则原样返回。
+//
+// 开启 RestrictLocal 时不访问本地文件，相对路径原样返回；file:// 地址、绝对路径和通过 ../ 跳出 BaseDir 的路径不允许使用，返回 false。
+func (r *DocxRenderer) localLinkTarget(dest string) (string, bool) {
+	if "" == dest || strings.HasPrefix(dest, "#") || strings.HasPrefix(dest, "//") {
+		return dest, true
+	}
+	u, err := url.Parse(dest)
+	if nil != err {
+		return dest, true
+	}
+	if "" != u.Scheme && !isWindowsVolume(u.Scheme) {
+		return dest, !r.RestrictLocal || "file" != strings.ToLower(u.Scheme)
+	}
+
+	p, fragment := dest, ""
+	if i := strings.Index(dest, "#"); 0 <= i {
+		p, fragment = dest[:i], dest[i:]
+	}
+	if r.RestrictLocal {
+		return dest, !isWindowsVolume(u.Scheme) && isRelativeSubPath(p)
+	}
+	localPath, ok := r.resolveLocalPath(p)
+	if !ok {
+		return dest, true
+	}
+	absPath, err := filepath.Abs(localPath)
+	if nil != err {
+		return dest, true
+	}
+	absPath = filepath.ToSlash(absPath)
+	if !strings.HasPrefix(absPath, "/") {
+		absPath = "/" + absPath
+	}
+	return (&url.URL{Scheme: "file", Path: absPath}).String() + fragment, true
+}
+
+// isRelativeSubPath 判断路径 p 是否是不会跳出所在目录的相对路径，p 中的 URL 转义和反斜杠分隔符也会考虑在内。
+func isRelativeSubPath(p string) bool {
+	candidates := []string{p}
+	if unescaped, err := url.PathUnescape(p); nil == err && unescaped != p {
+		candidates = append(candidates, unescaped)
+	}
+	for _, candidate := range candidates {
+		candidate = path.Clean(strings.ReplaceAll(candidate, "\\", "/"))
+		if strings.HasPrefix(candidate, "/") || ".." == candidate || strings.HasPrefix(candidate, "../") {
+			return false
+		}
+	}
+	return true
+}
+
+// isWindowsVolume 判断 URL 解析出的 scheme 是否是 Windows 盘符，比如 D:/images/a.png 中的 D。
+func isWindowsVolume(scheme string) bool {
+	return 1 == len(scheme)
+}
+
+// fileExists 判断 p 是否是存在的文件。
+func fileExists(p string) bool {
+	info, err := os.Stat(p)
+	return nil == err && !info.IsDir()
+}
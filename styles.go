@@ -0,0 +1,203 @@
+// Lute DOCX - 一款将 Markdown 文本转换为 Word 文档 (.docx) 的小工具
+// Copyright (c) 2020-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/88250/lute/parse"
+	"github.com/88250/lute/render"
+	"github.com/skip2/go-qrcode"
+	"github.com/unidoc/unioffice/color"
+	"github.com/unidoc/unioffice/document"
+	"github.com/unidoc/unioffice/measurement"
+	"github.com/unidoc/unioffice/schema/soo/wml"
+)
+
+// styleSampleMarkdown 是导出样式参考文档时使用的示例内容，需要覆盖所有内置样式。
+const styleSampleMarkdown = `# 一级标题 Heading 1
+
+## 二级标题 Heading 2
+
+### 三级标题 Heading 3
+
+#### 四级标题 Heading 4
+
+##### 五级标题 Heading 5
+
+###### 六级标题 Heading 6
+
+正文段落，包含**粗体**、*斜体*、~~删除线~~、` + "`行内代码 Code`" + ` 和[超链接 Hyperlink](https://github.com/88250/lute-docx)。
+
+> 引述 Quote：修改样式后将该文档作为参考文档使用。
+
+` + "```go" + `
+// 代码块 Code Block
+func main() {
+	println("Lute DOCX")
+}
+` + "```" + `
+
+* 列表项
+* 列表项
+`
+
+// styleSampleImage 是样式参考文档中的示例图片（项目地址的二维码）的地址，图片内容由内存图片解析器提供。
+const styleSampleImage = "lute-docx-sample.png"
+
+// styleSampleFigure 是样式参考文档中的示例图片，%s 为示例图片路径。
+const styleSampleFigure = `
+
+![示例图片](%s "题注 Caption")
+`
+
+// ExportStyles 将主题 theme 下渲染时使用的所有样式连同示例内容导出到 docxPath，在 Word 中修改样式后可以作为参考文档使用。
+func ExportStyles(docxPath string, theme *DocxTheme) {
+	markdown := styleSampleMarkdown
+	images := MapImageResolver{}
+	if data, err := qrcode.Encode("https://github.com/88250/lute-docx", qrcode.Medium, 256); nil == err {
+		images[styleSampleImage] = data
+		markdown += fmt.Sprintf(styleSampleFigure, styleSampleImage)
+	} else {
+		logger.Warnf("generate sample image failed: %s", err)
+	}
+
+	options := parse.NewOptions()
+	tree := parse.Parse("", []byte(markdown), options)
+	renderer := NewDocxRenderer(tree, render.NewOptions())
+	renderer.Theme = theme
+	renderer.ImageResolver = images
+	renderer.Render()
+	renderer.Save(docxPath)
+}
+
+// initStyles 按照主题 theme 初始化渲染时使用的样式。
+func (r *DocxRenderer) initStyles(theme *DocxTheme) {
+	r.styleIDs = map[string]string{}
+
+	r.addStyle("Hyperlink", "Hyperlink", wml.ST_StyleTypeCharacter, func(style document.Style) {
+		style.SetBasedOn("DefaultParagraphFont")
+		linkColor := color.FromHex(theme.LinkColor)
+		style.RunProperties().Color().SetColor(linkColor)
+		style.RunProperties().SetUnderline(wml.ST_UnderlineSingle, linkColor)
+	})
+
+	r.addStyle("Code", "Code", wml.ST_StyleTypeCharacter, func(style document.Style) {
+		style.SetBasedOn("DefaultParagraphFont")
+		codeColor := color.FromHex(theme.CodeColor)
+		style.RunProperties().Color().SetColor(codeColor)
+		style.RunProperties().SetUnderline(wml.ST_UnderlineSingle, codeColor)
+		setFonts(style.RunProperties().X(), &theme.CodeFonts)
+	})
+
+	r.addStyle("CodeBlock", "Code Block", wml.ST_StyleTypeCharacter, func(style document.Style) {
+		style.SetBasedOn("DefaultParagraphFont")
+		codeBlockColor := color.FromHex(theme.CodeBlockColor)
+		style.RunProperties().Color().SetColor(codeBlockColor)
+		style.RunProperties().SetUnderline(wml.ST_UnderlineSingle, codeBlockColor)
+		setFonts(style.RunProperties().X(), &theme.CodeFonts)
+	})
+
+	r.addStyle("Quote", "Quote", wml.ST_StyleTypeParagraph, func(style document.Style) {
+		style.ParagraphProperties().SetLeftIndent(22 * measurement.Point)
+		style.RunProperties().Color().SetColor(color.FromHex(theme.QuoteColor))
+	})
+
+	r.addStyle("Caption", "caption", wml.ST_StyleTypeParagraph, func(style document.Style) {
+		style.ParagraphProperties().SetAlignment(wml.ST_JcCenter)
+		style.RunProperties().SetSize(measurement.Distance(r.fontSize * 0.9))
+		if "" != theme.QuoteColor {
+			style.RunProperties().Color().SetColor(color.FromHex(theme.QuoteColor))
+		}
+	})
+
+	// 目录和插图目录的标题，样式和一级标题一致，但不设置大纲级别，这样标题本身不会出现在目录中
+	r.addStyle("TOCHeading", "TOC Heading", wml.ST_StyleTypeParagraph, func(style document.Style) {
+		style.ParagraphProperties().SetKeepNext(true)
+		style.RunProperties().SetBold(true)
+		style.RunProperties().SetSize(measurement.Distance(r.heading1Size))
+		setFonts(style.RunProperties().X(), &theme.HeadingFonts)
+		if "" != theme.HeadingColor {
+			style.RunProperties().Color().SetColor(color.FromHex(theme.HeadingColor))
+		}
+	})
+
+	headingSizes := []float64{r.heading1Size, r.heading2Size, r.heading3Size, r.heading4Size, r.heading5Size, r.heading6Size}
+	for i, size := range headingSizes {
+		level := strconv.Itoa(i + 1)
+		outlineLevel := i
+		headingSize := measurement.Distance(size)
+		initHeading := func(style document.Style) {
+			style.ParagraphProperties().SetKeepNext(true)
+			style.ParagraphProperties().SetOutlineLevel(outlineLevel)
+			style.RunProperties().SetBold(true)
+			style.RunProperties().SetSize(headingSize)
+			setFonts(style.RunProperties().X(), &theme.HeadingFonts)
+			if "" != theme.HeadingColor {
+				style.RunProperties().Color().SetColor(color.FromHex(theme.HeadingColor))
+			}
+		}
+		if style, created := r.addStyle("Heading"+level, "heading "+level, wml.ST_StyleTypeParagraph, initHeading); !created && !r.referenceDoc {
+			// 覆盖 unioffice 默认的标题样式
+			initHeading(style)
+		}
+	}
+}
+
+// addStyle 添加一个 ID 为 id、名称为 name 的样式。文档（比如参考文档）中已经存在同名或者同 ID 的样式时使用已有样式，
+// 否则新建样式并使用 init 初始化，created 表示是否新建了样式。
+func (r *DocxRenderer) addStyle(id, name string, t wml.ST_StyleType, init func(style document.Style)) (ret document.Style, created bool) {
+	styleID := id
+	for _, style := range r.doc.Styles.Styles() {
+		if t == style.Type() && normalizeStyleName(name) == normalizeStyleName(style.Name()) {
+			r.styleIDs[id] = style.StyleID()
+			return style, false
+		}
+	}
+	for _, style := range r.doc.Styles.Styles() {
+		if id != style.StyleID() {
+			continue
+		}
+		if t == style.Type() {
+			r.styleIDs[id] = id
+			return style, false
+		}
+		// 不同类型的样式不能使用相同的 ID
+		styleID = "Lute" + id
+	}
+
+	ret = r.doc.Styles.AddStyle(styleID, t, false)
+	ret.SetName(name)
+	init(ret)
+	r.styleIDs[id] = styleID
+	return ret, true
+}
+
+// styleID 返回渲染使用的样式 id 在文档中实际对应的样式 ID。
+func (r *DocxRenderer) styleID(id string) string {
+	if ret, ok := r.styleIDs[id]; ok {
+		return ret
+	}
+	return id
+}
+
+// normalizeStyleName 规范化样式名称，比如 Heading 1 规范化为 heading1。
+func normalizeStyleName(name string) string {
+	return strings.ToLower(strings.ReplaceAll(name, " ", ""))
+}
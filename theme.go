@@ -0,0 +1,286 @@
+// Lute DOCX - 一款将 Markdown 文本转换为 Word 文档 (.docx) 的小工具
+// Copyright (c) 2020-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math"
+	"strings"
+
+	"github.com/unidoc/unioffice"
+	"github.com/unidoc/unioffice/schema/soo/ofc/sharedTypes"
+	"github.com/unidoc/unioffice/schema/soo/wml"
+	"gopkg.in/yaml.v3"
+)
+
+// DocxTheme 描述了 DOCX 主题，字号和行高均为缩放前的大小（磅）。
+type DocxTheme struct {
+	Name           string    `yaml:"name"`           // 主题名称
+	Zoom           float64   `yaml:"zoom"`           // 字号、行高缩放倍数
+	FontSize       float64   `yaml:"fontSize"`       // 正文字号
+	LineHeight     float64   `yaml:"lineHeight"`     // 行高，作为段落的最小行距
+	SpaceAfter     float64   `yaml:"spaceAfter"`     // 段后间距（磅）
+	HeadingSizes   []float64 `yaml:"headingSizes"`   // 一级到六级标题字号
+	HeadingColor   string    `yaml:"headingColor"`   // 标题颜色，为空时使用正文颜色
+	LinkColor      string    `yaml:"linkColor"`      // 超链接颜色
+	CodeColor      string    `yaml:"codeColor"`      // 行内代码颜色
+	CodeBlockColor string    `yaml:"codeBlockColor"` // 代码块颜色
+	QuoteColor     string    `yaml:"quoteColor"`     // 引述颜色
+	BodyFonts      DocxFonts `yaml:"bodyFonts"`      // 正文字体
+	HeadingFonts   DocxFonts `yaml:"headingFonts"`   // 标题字体
+	CodeFonts      DocxFonts `yaml:"codeFonts"`      // 代码字体
+	EmojiFont      string    `yaml:"emojiFont"`      // Emoji 字体，比如 Segoe UI Emoji、Noto Color Emoji
+	Lang           string    `yaml:"lang"`           // 西文语言，比如 en-US
+	EastAsiaLang   string    `yaml:"eastAsiaLang"`   // 东亚语言，比如 zh-CN，为空时按照语言环境确定
+}
+
+// DocxFonts 描述了一组字体，中英文混排时西文字符使用西文字体，中日韩字符使用东亚字体，为空时使用 Word 的默认字体。
+type DocxFonts struct {
+	Latin    string `yaml:"latin"`    // 西文字体（ascii、hAnsi），比如 Times New Roman、Calibri
+	EastAsia string `yaml:"eastAsia"` // 东亚字体，比如宋体、黑体
+	CS       string `yaml:"cs"`       // 复杂文种字体，比如阿拉伯文、希伯来文
+}
+
+// themes 定义了内置的主题。
+var themes = map[string]*DocxTheme{
+	"light": {
+		Name:           "light",
+		Zoom:           0.8,
+		FontSize:       14,
+		LineHeight:     24,
+		HeadingSizes:   []float64{24, 22, 20, 18, 16, 14},
+		LinkColor:      "#4285F4",
+		CodeColor:      "#FF9933",
+		CodeBlockColor: "#569E3D",
+		QuoteColor:     "#6A737D",
+		BodyFonts:      DocxFonts{Latin: "Calibri", EastAsia: "微软雅黑"},
+		HeadingFonts:   DocxFonts{Latin: "Calibri", EastAsia: "微软雅黑"},
+		CodeFonts:      DocxFonts{Latin: "Consolas", EastAsia: "微软雅黑"},
+		EmojiFont:      "Segoe UI Emoji",
+		Lang:           "en-US",
+	},
+	"print": {
+		Name:           "print",
+		Zoom:           1,
+		FontSize:       10.5,
+		LineHeight:     18,
+		SpaceAfter:     6,
+		HeadingSizes:   []float64{22, 18, 16, 14, 12, 10.5},
+		HeadingColor:   "#000000",
+		LinkColor:      "#000000",
+		CodeColor:      "#333333",
+		CodeBlockColor: "#333333",
+		QuoteColor:     "#555555",
+		BodyFonts:      DocxFonts{Latin: "Times New Roman", EastAsia: "宋体", CS: "Times New Roman"},
+		HeadingFonts:   DocxFonts{Latin: "Arial", EastAsia: "黑体", CS: "Arial"},
+		CodeFonts:      DocxFonts{Latin: "Courier New", EastAsia: "宋体", CS: "Courier New"},
+		EmojiFont:      "Segoe UI Emoji",
+		Lang:           "en-US",
+	},
+	"dark-accent": {
+		Name:           "dark-accent",
+		Zoom:           0.8,
+		FontSize:       14,
+		LineHeight:     24,
+		HeadingSizes:   []float64{24, 22, 20, 18, 16, 14},
+		HeadingColor:   "#1F3864",
+		LinkColor:      "#0B5394",
+		CodeColor:      "#A61C00",
+		CodeBlockColor: "#274E13",
+		QuoteColor:     "#37474F",
+		BodyFonts:      DocxFonts{Latin: "Calibri", EastAsia: "微软雅黑"},
+		HeadingFonts:   DocxFonts{Latin: "Calibri", EastAsia: "微软雅黑"},
+		CodeFonts:      DocxFonts{Latin: "Consolas", EastAsia: "微软雅黑"},
+		EmojiFont:      "Segoe UI Emoji",
+		Lang:           "en-US",
+	},
+}
+
+// Theme 返回名称为 name 的内置主题。
+func Theme(name string) (*DocxTheme, bool) {
+	theme, ok := themes[strings.ToLower(name)]
+	return theme, ok
+}
+
+// LoadTheme 从 YAML（或者 JSON）文件 path 中加载自定义主题，未设置的字段使用 light 主题的值，比如：
+//
+//	name: custom
+//	fontSize: 12
+//	lineHeight: 20
+//	headingSizes: [26, 22, 18, 16, 14, 12]
+//	linkColor: "#1A73E8"
+func LoadTheme(path string) (*DocxTheme, error) {
+	data, err := ioutil.ReadFile(path)
+	if nil != err {
+		return nil, err
+	}
+
+	ret := *themes["light"]
+	ret.HeadingSizes = append([]float64{}, ret.HeadingSizes...)
+	if err = yaml.Unmarshal(data, &ret); nil != err {
+		return nil, err
+	}
+	if err = ret.Validate(); nil != err {
+		return nil, err
+	}
+	return &ret, nil
+}
+
+// Validate 检查主题中的字号、行高和段后间距，它们都不能为负数，正文字号需要大于 0。
+func (theme *DocxTheme) Validate() error {
+	if 0 >= theme.FontSize {
+		return fmt.Errorf("invalid font size [%v], must be positive", theme.FontSize)
+	}
+	if 0 > theme.Zoom {
+		return fmt.Errorf("invalid zoom [%v], must not be negative", theme.Zoom)
+	}
+	if 0 > theme.LineHeight {
+		return fmt.Errorf("invalid line height [%v], must not be negative", theme.LineHeight)
+	}
+	if 0 > theme.SpaceAfter {
+		return fmt.Errorf("invalid space after [%v], must not be negative", theme.SpaceAfter)
+	}
+	for i, size := range theme.HeadingSizes {
+		if 0 > size {
+			return fmt.Errorf("invalid heading %d size [%v], must not be negative", i+1, size)
+		}
+	}
+	return nil
+}
+
+// applyTheme 按照主题计算字号、设置段落间距并初始化样式，只在第一次渲染前执行一次。
+func (r *DocxRenderer) applyTheme() {
+	if nil != r.styleIDs {
+		return
+	}
+
+	theme := r.Theme
+	if nil == theme {
+		theme = themes["light"]
+	}
+	r.zoom = theme.Zoom
+	if 0 >= r.zoom {
+		r.zoom = 1
+	}
+	r.fontSize = theme.FontSize * r.zoom
+	r.lineHeight = theme.LineHeight * r.zoom
+	r.emojiFont = theme.EmojiFont
+	headingSizes := []*float64{&r.heading1Size, &r.heading2Size, &r.heading3Size, &r.heading4Size, &r.heading5Size, &r.heading6Size}
+	for i, size := range headingSizes {
+		if i < len(theme.HeadingSizes) {
+			*size = theme.HeadingSizes[i] * r.zoom
+		} else {
+			*size = themes["light"].HeadingSizes[i] * r.zoom
+		}
+	}
+	r.initStyles(theme)
+
+	if r.referenceDoc {
+		// 使用参考文档时正文格式由参考文档决定
+		return
+	}
+
+	docDefaults := r.doc.Styles.X().DocDefaults
+	if nil == docDefaults.RPrDefault {
+		docDefaults.RPrDefault = wml.NewCT_RPrDefault()
+	}
+	if nil == docDefaults.RPrDefault.RPr {
+		docDefaults.RPrDefault.RPr = wml.NewCT_RPr()
+	}
+	docDefaults.RPrDefault.RPr.Sz = wml.NewCT_HpsMeasure()
+	docDefaults.RPrDefault.RPr.Sz.ValAttr.ST_UnsignedDecimalNumber = halfPoints(r.fontSize)
+	docDefaults.RPrDefault.RPr.SzCs = wml.NewCT_HpsMeasure()
+	docDefaults.RPrDefault.RPr.SzCs.ValAttr.ST_UnsignedDecimalNumber = halfPoints(r.fontSize)
+	setFonts(docDefaults.RPrDefault.RPr, &theme.BodyFonts)
+	r.setLang(docDefaults.RPrDefault.RPr, theme)
+
+	if nil == docDefaults.PPrDefault {
+		docDefaults.PPrDefault = wml.NewCT_PPrDefault()
+	}
+	if nil == docDefaults.PPrDefault.PPr {
+		docDefaults.PPrDefault.PPr = wml.NewCT_PPrGeneral()
+	}
+	spacing := wml.NewCT_Spacing()
+	if 0 < r.lineHeight {
+		spacing.LineAttr = &wml.ST_SignedTwipsMeasure{Int64: pointTwips(r.lineHeight)}
+		// 使用最小行距，避免行内图片被裁剪
+		spacing.LineRuleAttr = wml.ST_LineSpacingRuleAtLeast
+	}
+	spaceAfter := math.Max(0, theme.SpaceAfter)
+	spacing.AfterAttr = &sharedTypes.ST_TwipsMeasure{ST_UnsignedDecimalNumber: unioffice.Uint64(uint64(*pointTwips(spaceAfter)))}
+	docDefaults.PPrDefault.PPr.Spacing = spacing
+}
+
+// setFonts 将字体 fonts 设置到文本属性 rPr 上，未设置的字体保持不变。
+func setFonts(rPr *wml.CT_RPr, fonts *DocxFonts) {
+	if "" == fonts.Latin && "" == fonts.EastAsia && "" == fonts.CS {
+		return
+	}
+
+	if nil == rPr.RFonts {
+		rPr.RFonts = wml.NewCT_Fonts()
+	}
+	// 主题字体的优先级高于显式指定的字体，所以需要清除对应的主题字体
+	if "" != fonts.Latin {
+		rPr.RFonts.AsciiAttr = unioffice.String(fonts.Latin)
+		rPr.RFonts.HAnsiAttr = unioffice.String(fonts.Latin)
+		rPr.RFonts.AsciiThemeAttr = wml.ST_ThemeUnset
+		rPr.RFonts.HAnsiThemeAttr = wml.ST_ThemeUnset
+	}
+	if "" != fonts.EastAsia {
+		rPr.RFonts.EastAsiaAttr = unioffice.String(fonts.EastAsia)
+		rPr.RFonts.EastAsiaThemeAttr = wml.ST_ThemeUnset
+	}
+	if "" != fonts.CS {
+		rPr.RFonts.CsAttr = unioffice.String(fonts.CS)
+		rPr.RFonts.CsthemeAttr = wml.ST_ThemeUnset
+	}
+}
+
+// setLang 按照主题 theme 和语言环境设置文本属性 rPr 的语言，Word 根据语言选择字体、断词和拼写检查。
+func (r *DocxRenderer) setLang(rPr *wml.CT_RPr, theme *DocxTheme) {
+	lang := theme.Lang
+	if "" == lang {
+		lang = "en-US"
+	}
+	eastAsiaLang := theme.EastAsiaLang
+	if "" == eastAsiaLang {
+		eastAsiaLang = "zh-CN"
+		if locale, ok := normalizeLocale(r.Locale); ok && "en_US" != locale {
+			eastAsiaLang = strings.ReplaceAll(locale, "_", "-")
+		}
+	}
+
+	if nil == rPr.Lang {
+		rPr.Lang = wml.NewCT_Language()
+	}
+	rPr.Lang.ValAttr = unioffice.String(lang)
+	rPr.Lang.EastAsiaAttr = unioffice.String(eastAsiaLang)
+}
+
+// halfPoints 将磅转换为 DOCX 中以半磅为单位的字号，负数按照 0 处理。
+func halfPoints(points float64) *uint64 {
+	ret := uint64(math.Max(0, math.Round(points*2)))
+	return &ret
+}
+
+// pointTwips 将磅转换为缇。
+func pointTwips(points float64) *int64 {
+	ret := int64(math.Round(points * 20))
+	return &ret
+}